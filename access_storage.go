@@ -0,0 +1,67 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// an access entity name or cluster, quoted or not
+	accessEntityNamePattern = "(?:'[^']*'|\"[^\"]*\"|`[^`]*`|[\\w{}.-]+)"
+	accessEntityKinds       = `(?:USER|ROLE|SETTINGS\s+PROFILE|PROFILE|QUOTA)`
+)
+
+var (
+	accessStorageNameRegexp  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	createAccessEntityRegexp = regexp.MustCompile(`(?is)^(\s*CREATE\s+` + accessEntityKinds +
+		`\s+(?:IF\s+NOT\s+EXISTS\s+|OR\s+REPLACE\s+)?` + accessEntityNamePattern +
+		`(?:\s+ON\s+CLUSTER\s+` + accessEntityNamePattern + `)?)`)
+	dropAccessEntityRegexp = regexp.MustCompile(`(?is)^\s*DROP\s+` + accessEntityKinds + `\s`)
+	quotedRegexp           = regexp.MustCompile("'(?:[^'\\\\]|\\\\.)*'|\"[^\"]*\"|`[^`]*`")
+	inStorageRegexp        = regexp.MustCompile(`(?i)\bIN\s+\w`)
+	fromStorageRegexp      = regexp.MustCompile(`(?i)\bFROM\s+\w`)
+)
+
+// validateAccessStorage checks that storage is a writable access storage of
+// the server, as listed in system.user_directories
+func validateAccessStorage(storage string, capabilities *serverCapabilities) error {
+	if !accessStorageNameRegexp.MatchString(storage) {
+		return fmt.Errorf("invalid access_storage: %q is not a valid storage name", storage)
+	}
+	if capabilities == nil {
+		return nil
+	}
+	storageType, ok := capabilities.accessStorages[storage]
+	if !ok {
+		return fmt.Errorf("invalid access_storage: %s not found in system.user_directories", storage)
+	}
+	if storageType == "users_xml" {
+		return fmt.Errorf("invalid access_storage: %s is read-only", storage)
+	}
+
+	return nil
+}
+
+// withAccessStorage makes query create its access entity IN storage, or drop
+// it FROM storage, unless query already names a storage.
+func withAccessStorage(query string, storage string) string {
+	if storage == "" {
+		return query
+	}
+	if loc := createAccessEntityRegexp.FindStringIndex(query); loc != nil {
+		if inStorageRegexp.MatchString(quotedRegexp.ReplaceAllString(query[loc[1]:], "''")) {
+			return query
+		}
+
+		return query[:loc[1]] + " IN " + storage + query[loc[1]:]
+	}
+	if dropAccessEntityRegexp.MatchString(query) {
+		if fromStorageRegexp.MatchString(quotedRegexp.ReplaceAllString(query, "''")) {
+			return query
+		}
+
+		return query + " FROM " + storage
+	}
+
+	return query
+}
@@ -0,0 +1,125 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+)
+
+func Test_withAccessStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		storage string
+		want    string
+	}{
+		{
+			name:    "Should not change queries without access storage",
+			query:   "CREATE USER 'bob' IDENTIFIED BY 'secret'",
+			storage: "",
+			want:    "CREATE USER 'bob' IDENTIFIED BY 'secret'",
+		},
+		{
+			name:    "Should create a user in the access storage",
+			query:   "CREATE USER 'bob' IDENTIFIED BY 'secret'",
+			storage: "replicated",
+			want:    "CREATE USER 'bob' IN replicated IDENTIFIED BY 'secret'",
+		},
+		{
+			name:    "Should create a user in the access storage after ON CLUSTER",
+			query:   "CREATE USER IF NOT EXISTS 'bob' ON CLUSTER '{cluster}' IDENTIFIED BY 'secret' SETTINGS max_threads = 8",
+			storage: "local_directory",
+			want:    "CREATE USER IF NOT EXISTS 'bob' ON CLUSTER '{cluster}' IN local_directory IDENTIFIED BY 'secret' SETTINGS max_threads = 8",
+		},
+		{
+			name:    "Should create settings profiles and quotas in the access storage",
+			query:   "CREATE SETTINGS PROFILE bob_profile SETTINGS max_memory_usage = 100 TO bob",
+			storage: "replicated",
+			want:    "CREATE SETTINGS PROFILE bob_profile IN replicated SETTINGS max_memory_usage = 100 TO bob",
+		},
+		{
+			name:    "Should keep the access storage of the query",
+			query:   "CREATE ROLE 'reader' IN local_directory",
+			storage: "replicated",
+			want:    "CREATE ROLE 'reader' IN local_directory",
+		},
+		{
+			name:    "Should not mistake a password for an access storage",
+			query:   "CREATE USER 'bob' IDENTIFIED BY 'in secret'",
+			storage: "replicated",
+			want:    "CREATE USER 'bob' IN replicated IDENTIFIED BY 'in secret'",
+		},
+		{
+			name:    "Should drop a user from the access storage",
+			query:   "DROP USER IF EXISTS 'bob'",
+			storage: "replicated",
+			want:    "DROP USER IF EXISTS 'bob' FROM replicated",
+		},
+		{
+			name:    "Should keep the access storage of a drop",
+			query:   "DROP QUOTA IF EXISTS bob_quota FROM local_directory",
+			storage: "replicated",
+			want:    "DROP QUOTA IF EXISTS bob_quota FROM local_directory",
+		},
+		{
+			name:    "Should not change other statements",
+			query:   "GRANT readonly TO 'bob'",
+			storage: "replicated",
+			want:    "GRANT readonly TO 'bob'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withAccessStorage(tt.query, tt.storage); got != tt.want {
+				t.Errorf("withAccessStorage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateAccessStorage(t *testing.T) {
+	capabilities := &serverCapabilities{accessStorages: map[string]string{
+		"users_xml":       "users_xml",
+		"local_directory": "local_directory",
+		"replicated":      "replicated",
+	}}
+	tests := []struct {
+		name         string
+		storage      string
+		capabilities *serverCapabilities
+		wantErr      bool
+	}{
+		{
+			name:         "Should accept a writable storage",
+			storage:      "replicated",
+			capabilities: capabilities,
+		},
+		{
+			name:    "Should accept any storage name while capabilities are unknown",
+			storage: "replicated",
+		},
+		{
+			name:         "Should reject an unknown storage",
+			storage:      "ldap",
+			capabilities: capabilities,
+			wantErr:      true,
+		},
+		{
+			name:         "Should reject a read-only storage",
+			storage:      "users_xml",
+			capabilities: capabilities,
+			wantErr:      true,
+		},
+		{
+			name:    "Should reject an invalid storage name",
+			storage: "replicated; DROP USER admin",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAccessStorage(tt.storage, tt.capabilities)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateAccessStorage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+)
+
+// Admin runs the operations of the plugin outside of Vault, for the command
+// line of the plugin binary. Its errors have the secrets of the
+// configuration masked, as the ones the plugin returns to Vault, and so do
+// the errors they wrap, e.g. a *StatementError.
+type Admin struct {
+	db *Clickhouse
+}
+
+// ServerInfo describes the server detected by a verified Initialize
+type ServerInfo struct {
+	Address string `json:"address"`
+	Version string `json:"version"`
+	// AccessStorages maps the names of system.user_directories to their type
+	AccessStorages map[string]string `json:"access_storages"`
+}
+
+// NewAdmin returns an Admin for the plugin configuration to be passed to Initialize
+func NewAdmin(opts ...Option) *Admin {
+	db := newClickhouse(DefaultUserNameTemplate)
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	return &Admin{db: db}
+}
+
+// Initialize initializes the plugin with config, the one of
+// database/config/<name> in Vault
+func (a *Admin) Initialize(ctx context.Context, config map[string]interface{}, verifyConnection bool) error {
+	_, err := a.db.Initialize(ctx, dbplugin.InitializeRequest{
+		Config:           config,
+		VerifyConnection: verifyConnection,
+	})
+
+	return a.sanitize(err, nil)
+}
+
+// Server returns the server detected by a verified Initialize, nil otherwise
+func (a *Admin) Server() *ServerInfo {
+	if a.db.capabilities == nil {
+		return nil
+	}
+
+	return &ServerInfo{
+		Address:        a.db.addr,
+		Version:        a.db.capabilities.version.String(),
+		AccessStorages: maps.Clone(a.db.capabilities.accessStorages),
+	}
+}
+
+// RenderNewUser returns the username NewUser would generate for req, and the
+// queries it would run
+func (a *Admin) RenderNewUser(req dbplugin.NewUserRequest) (string, []string, error) {
+	username, statements, queryMap, err := a.db.newUserStatements(req)
+	if err != nil {
+		return "", nil, a.sanitize(err, queryMap)
+	}
+	queries, err := a.db.renderStatements(operationNewUser, statements, queryMap)
+
+	return username, queries, a.sanitize(err, queryMap)
+}
+
+// RenderUpdateUser returns the queries UpdateUser would run to change the
+// password of the user of req
+func (a *Admin) RenderUpdateUser(req dbplugin.UpdateUserRequest) ([]string, error) {
+	if req.Password == nil {
+		return nil, errors.New("no password change requested")
+	}
+	statements, queryMap := updatePasswordStatements(req.Username, req.Password)
+	queries, err := a.db.renderStatements(operationUpdateUser, statements, queryMap)
+
+	return queries, a.sanitize(err, queryMap)
+}
+
+// RenderDeleteUser returns the queries DeleteUser would run for req
+func (a *Admin) RenderDeleteUser(req dbplugin.DeleteUserRequest) ([]string, error) {
+	statements, queryMap, err := a.db.deleteUserStatements(req)
+	if err != nil {
+		return nil, a.sanitize(err, queryMap)
+	}
+	queries, err := a.db.renderStatements(operationDeleteUser, statements, queryMap)
+
+	return queries, a.sanitize(err, queryMap)
+}
+
+// NewUser creates a user as Vault does for dynamic credentials
+func (a *Admin) NewUser(ctx context.Context, req dbplugin.NewUserRequest) (dbplugin.NewUserResponse, error) {
+	resp, err := a.db.NewUser(ctx, req)
+
+	return resp, a.sanitize(err, map[string]string{"password": req.Password})
+}
+
+// DeleteUser revokes a user as Vault does when a lease expires
+func (a *Admin) DeleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
+	resp, err := a.db.DeleteUser(ctx, req)
+
+	return resp, a.sanitize(err, nil)
+}
+
+// ListUsers returns the names of the users starting with prefix, e.g. v- for
+// the users of the default username template, in alphabetical order
+func (a *Admin) ListUsers(ctx context.Context, prefix string) ([]string, error) {
+	a.db.Lock()
+	defer a.db.Unlock()
+
+	db, err := a.db.getConnection(ctx)
+	if err != nil {
+		return nil, a.sanitize(err, nil)
+	}
+	names, err := queryStrings(ctx, db, "SELECT name FROM system.users ORDER BY name")
+	if err != nil {
+		return nil, a.sanitize(err, nil)
+	}
+	users := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			users = append(users, name)
+		}
+	}
+
+	return users, nil
+}
+
+// Close closes the connection pool
+func (a *Admin) Close() error {
+	return a.db.Close()
+}
+
+// sanitize masks the secrets of the configuration, and the password of
+// queryMap, in err
+func (a *Admin) sanitize(err error, queryMap map[string]string) error {
+	return a.db.sanitizeError(err, queryMap)
+}
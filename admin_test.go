@@ -0,0 +1,46 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	clickhousehelper "github.com/contentsquare/vault-plugin-database-clickhouse/testhelpers/clickhouse"
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin_sanitizedErrors(t *testing.T) {
+	srv := clickhousehelper.StartFakeServer(t, "admin", "s3cr3t-adm1n")
+	srv.AddUser("v_reader", "existing")
+	admin := NewAdmin()
+	defer admin.Close() //nolint:errcheck
+	require.NoError(t, admin.Initialize(t.Context(), map[string]interface{}{
+		"connection_url":    srv.URL(),
+		"username_template": "v_{{ .RoleName }}",
+	}, true))
+
+	_, err := admin.NewUser(t.Context(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+		Statements:     dbplugin.Statements{Commands: []string{`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'`}},
+		Password:       "09g8hanbdfkVSM",
+		Expiration:     time.Now().Add(time.Minute),
+	})
+	require.ErrorIs(t, err, ErrUserAlreadyExists)
+	var stmtErr *StatementError
+	require.ErrorAs(t, err, &stmtErr)
+	require.Equal(t, codeAccessEntityAlreadyExists, stmtErr.Code())
+
+	wrongAdmin := NewAdmin()
+	defer wrongAdmin.Close() //nolint:errcheck
+	err = wrongAdmin.Initialize(t.Context(), map[string]interface{}{
+		"connection_url":         srv.URL(),
+		"password":               "wr0ng-s3cr3t",
+		"retry_max_elapsed_time": "0s",
+	}, true)
+	var exception *clickhouse.Exception
+	require.ErrorAs(t, err, &exception)
+	require.Equal(t, codeAuthenticationFailed, exception.Code)
+	require.NotContains(t, err.Error(), "wr0ng-s3cr3t")
+	require.NotContains(t, exception.Message, "wr0ng-s3cr3t")
+}
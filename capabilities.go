@@ -0,0 +1,209 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	serverVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)`)
+	validUntilRegexp    = regexp.MustCompile(`(?i)\bVALID\s+UNTIL\b`)
+	sshKeyRegexp        = regexp.MustCompile(`(?i)\bssh_key\b`)
+	bcryptRegexp        = regexp.MustCompile(`(?i)\bbcrypt_(password|hash)\b`)
+	// access entity statements run ON CLUSTER, and the storage they name
+	onClusterAccessEntityRegexp = regexp.MustCompile(`(?is)^\s*(?:CREATE|ALTER|DROP)\s+` + accessEntityKinds + `\s.*\bON\s+CLUSTER\b`)
+	storageClauseRegexp         = regexp.MustCompile(`(?i)\b(?:IN|FROM)\s+(\w+)`)
+)
+
+// serverFeature is a statement feature only available from a server version
+type serverFeature struct {
+	name    string
+	major   int
+	minor   int
+	pattern *regexp.Regexp
+}
+
+func serverFeatures() []serverFeature {
+	return []serverFeature{
+		{name: "VALID UNTIL", major: 23, minor: 9, pattern: validUntilRegexp},
+		{name: "ssh_key authentication", major: 23, minor: 9, pattern: sshKeyRegexp},
+		{name: "bcrypt_password authentication", major: 23, minor: 5, pattern: bcryptRegexp},
+	}
+}
+
+// serverVersion is the major.minor version of a ClickHouse server
+type serverVersion struct {
+	major int
+	minor int
+	raw   string
+}
+
+func parseServerVersion(raw string) (serverVersion, error) {
+	match := serverVersionRegexp.FindStringSubmatch(raw)
+	if match == nil {
+		return serverVersion{}, fmt.Errorf("unable to parse server version. got=%s", raw)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+
+	return serverVersion{major: major, minor: minor, raw: raw}, nil
+}
+
+func (v serverVersion) atLeast(major int, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+func (v serverVersion) String() string {
+	return v.raw
+}
+
+// serverCapabilities describes what the ClickHouse server supports, as
+// detected when the connection is verified
+type serverCapabilities struct {
+	version serverVersion
+	// accessStorages maps the names of system.user_directories to their type
+	accessStorages map[string]string
+	// defaultAccessStorage is the writable storage of highest precedence,
+	// the one access entities are created in unless another one is named
+	defaultAccessStorage string
+	// ignoreOnClusterForReplicated is the server setting making ON CLUSTER a
+	// no-op for the access entities of replicated storages
+	ignoreOnClusterForReplicated bool
+}
+
+// replicatedAccessStorage reports whether the access entities of storage, or
+// of the default storage if empty, are replicated through Keeper. ON CLUSTER
+// statements on them fail on the replicas the entities already reached.
+func (s *serverCapabilities) replicatedAccessStorage(storage string) bool {
+	if s == nil {
+		return false
+	}
+	if storage == "" {
+		storage = s.defaultAccessStorage
+	}
+
+	return s.accessStorages[storage] == "replicated"
+}
+
+// rejectsOnCluster reports whether access entity statements on storage, the
+// default one if empty, fail when run ON CLUSTER: its entities are replicated
+// and the server does not ignore ON CLUSTER for them
+func (s *serverCapabilities) rejectsOnCluster(storage string) bool {
+	return s.replicatedAccessStorage(storage) && !s.ignoreOnClusterForReplicated
+}
+
+// UnsupportedFeatureError is returned when a statement uses a feature the
+// ClickHouse server is too old for, or that its configuration does not
+// support, in which case MinVersion is empty and Reason tells why.
+type UnsupportedFeatureError struct {
+	Feature       string
+	MinVersion    string
+	ServerVersion string
+	Reason        string
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	if e.MinVersion == "" {
+		return fmt.Sprintf("%s is not supported: %s", e.Feature, e.Reason)
+	}
+
+	return fmt.Sprintf("%s requires ClickHouse %s or later, the server runs %s", e.Feature, e.MinVersion, e.ServerVersion)
+}
+
+// checkStatement rejects query if it uses a feature the server does not
+// support. Nothing is checked while capabilities are unknown.
+func (s *serverCapabilities) checkStatement(query string) error {
+	if s == nil {
+		return nil
+	}
+	for _, feature := range serverFeatures() {
+		if !s.version.atLeast(feature.major, feature.minor) && feature.pattern.MatchString(query) {
+			return &UnsupportedFeatureError{
+				Feature:       feature.name,
+				MinVersion:    fmt.Sprintf("%d.%d", feature.major, feature.minor),
+				ServerVersion: s.version.String(),
+			}
+		}
+	}
+	// Names of the statement don't matter, and could contain ON CLUSTER
+	stripped := quotedRegexp.ReplaceAllString(query, "''")
+	if onClusterAccessEntityRegexp.MatchString(stripped) {
+		storage := ""
+		if match := storageClauseRegexp.FindStringSubmatch(stripped); match != nil {
+			storage = match[1]
+		}
+		if s.rejectsOnCluster(storage) {
+			if storage == "" {
+				storage = s.defaultAccessStorage
+			}
+
+			return &UnsupportedFeatureError{
+				Feature:       "ON CLUSTER",
+				ServerVersion: s.version.String(),
+				Reason:        fmt.Sprintf("the access entities of the replicated access storage %s are replicated through Keeper", storage),
+			}
+		}
+	}
+
+	return nil
+}
+
+// detectCapabilities queries the version and the access storages of the server
+func detectCapabilities(ctx context.Context, db *sql.DB) (*serverCapabilities, error) {
+	var raw string
+	if err := db.QueryRowContext(ctx, "SELECT version()").Scan(&raw); err != nil {
+		return nil, fmt.Errorf("unable to query the server version: %w", err)
+	}
+	version, err := parseServerVersion(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT name, type FROM system.user_directories ORDER BY precedence")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query the access storages: %w", err)
+	}
+	defer rows.Close()
+	capabilities := &serverCapabilities{version: version, accessStorages: map[string]string{}}
+	for rows.Next() {
+		var name, storageType string
+		if err = rows.Scan(&name, &storageType); err != nil {
+			return nil, fmt.Errorf("unable to query the access storages: %w", err)
+		}
+		storageType = strings.ToLower(storageType)
+		capabilities.accessStorages[name] = storageType
+		if capabilities.defaultAccessStorage == "" && storageType != "users_xml" {
+			capabilities.defaultAccessStorage = name
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query the access storages: %w", err)
+	}
+	for _, storageType := range capabilities.accessStorages {
+		if storageType == "replicated" {
+			capabilities.ignoreOnClusterForReplicated = queryIgnoreOnClusterForReplicated(ctx, db)
+
+			break
+		}
+	}
+
+	return capabilities, nil
+}
+
+// queryIgnoreOnClusterForReplicated returns the
+// ignore_on_cluster_for_replicated_access_entities_queries server setting,
+// false if the server does not expose it in system.server_settings
+func queryIgnoreOnClusterForReplicated(ctx context.Context, db *sql.DB) bool {
+	var value string
+	err := db.QueryRowContext(ctx, "SELECT value FROM system.server_settings WHERE name = 'ignore_on_cluster_for_replicated_access_entities_queries'").Scan(&value)
+	if err != nil {
+		return false
+	}
+	ignore, err := strconv.ParseBool(value)
+
+	return err == nil && ignore
+}
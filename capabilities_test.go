@@ -0,0 +1,216 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseServerVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		wantMajor int
+		wantMinor int
+		wantErr   bool
+	}{
+		{
+			name:      "Should parse a release version",
+			raw:       "23.8.2.7",
+			wantMajor: 23,
+			wantMinor: 8,
+		},
+		{
+			name:      "Should parse a version with a suffix",
+			raw:       "24.3.1.2672-lts",
+			wantMajor: 24,
+			wantMinor: 3,
+		},
+		{
+			name:    "Should reject an invalid version",
+			raw:     "bladibla",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerVersion(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServerVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.major != tt.wantMajor || got.minor != tt.wantMinor {
+				t.Errorf("parseServerVersion() = %d.%d, want %d.%d", got.major, got.minor, tt.wantMajor, tt.wantMinor)
+			}
+		})
+	}
+}
+
+func Test_serverCapabilities_checkStatement(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     string
+		query       string
+		wantFeature string
+	}{
+		{
+			name:    "Should accept a statement without versioned features",
+			version: "22.3.1.1",
+			query:   "CREATE USER 'bob' IDENTIFIED BY 'secret'",
+		},
+		{
+			name:        "Should reject VALID UNTIL on an old server",
+			version:     "23.8.2.7",
+			query:       "CREATE USER 'bob' IDENTIFIED BY 'secret' VALID UNTIL '2030-01-01 00:00:00'",
+			wantFeature: "VALID UNTIL",
+		},
+		{
+			name:    "Should accept VALID UNTIL on a recent server",
+			version: "23.9.1.1",
+			query:   "CREATE USER 'bob' IDENTIFIED BY 'secret' VALID UNTIL '2030-01-01 00:00:00'",
+		},
+		{
+			name:        "Should reject ssh_key on an old server",
+			version:     "23.3.1.1",
+			query:       "CREATE USER 'bob' IDENTIFIED WITH ssh_key BY KEY 'AAAA' TYPE 'ssh-ed25519'",
+			wantFeature: "ssh_key authentication",
+		},
+		{
+			name:        "Should reject bcrypt_password on an old server",
+			version:     "23.4.1.1",
+			query:       "CREATE USER 'bob' IDENTIFIED WITH bcrypt_password BY 'secret'",
+			wantFeature: "bcrypt_password authentication",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := parseServerVersion(tt.version)
+			require.NoError(t, err)
+			s := &serverCapabilities{version: version}
+
+			err = s.checkStatement(tt.query)
+			if tt.wantFeature == "" {
+				require.NoError(t, err)
+
+				return
+			}
+			var featureErr *UnsupportedFeatureError
+			require.ErrorAs(t, err, &featureErr)
+			require.Equal(t, tt.wantFeature, featureErr.Feature)
+			require.Equal(t, tt.version, featureErr.ServerVersion)
+		})
+	}
+}
+
+func Test_serverCapabilities_replicatedAccessStorage(t *testing.T) {
+	local := &serverCapabilities{
+		accessStorages:       map[string]string{"users_xml": "users_xml", "local_directory": "local_directory", "replicated": "replicated"},
+		defaultAccessStorage: "local_directory",
+	}
+	require.False(t, local.replicatedAccessStorage(""))
+	require.True(t, local.replicatedAccessStorage("replicated"))
+
+	replicated := &serverCapabilities{
+		accessStorages:       map[string]string{"users_xml": "users_xml", "replicated": "replicated"},
+		defaultAccessStorage: "replicated",
+	}
+	require.True(t, replicated.replicatedAccessStorage(""))
+	require.False(t, replicated.replicatedAccessStorage("users_xml"))
+}
+
+func Test_serverCapabilities_rejectsOnCluster(t *testing.T) {
+	s := &serverCapabilities{
+		accessStorages:       map[string]string{"local_directory": "local_directory", "replicated": "replicated"},
+		defaultAccessStorage: "local_directory",
+	}
+	require.False(t, s.rejectsOnCluster(""))
+	require.True(t, s.rejectsOnCluster("replicated"))
+
+	s.ignoreOnClusterForReplicated = true
+	require.False(t, s.rejectsOnCluster("replicated"))
+}
+
+func Test_serverCapabilities_checkStatement_onCluster(t *testing.T) {
+	s := &serverCapabilities{
+		version:              serverVersion{major: 24, minor: 3},
+		accessStorages:       map[string]string{"local_directory": "local_directory", "replicated": "replicated"},
+		defaultAccessStorage: "local_directory",
+	}
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{
+			name:  "Should accept ON CLUSTER on the local default storage",
+			query: "CREATE USER 'bob' ON CLUSTER my_cluster IDENTIFIED BY 'secret'",
+		},
+		{
+			name:    "Should reject ON CLUSTER on a replicated storage",
+			query:   "CREATE USER 'bob' ON CLUSTER my_cluster IDENTIFIED BY 'secret' IN replicated",
+			wantErr: true,
+		},
+		{
+			name:    "Should reject dropping ON CLUSTER from a replicated storage",
+			query:   "DROP USER IF EXISTS 'bob' ON CLUSTER my_cluster FROM replicated",
+			wantErr: true,
+		},
+		{
+			name:  "Should accept a replicated storage without ON CLUSTER",
+			query: "CREATE USER 'bob' IDENTIFIED BY 'secret' IN replicated",
+		},
+		{
+			name:  "Should ignore ON CLUSTER in quoted strings",
+			query: "CREATE USER 'bob' IDENTIFIED BY 'on cluster x' IN replicated",
+		},
+		{
+			name:  "Should accept ON CLUSTER for a statement on tables",
+			query: "GRANT ON CLUSTER my_cluster SELECT ON db.* TO 'bob'",
+		},
+	}
+	ignoring := *s
+	ignoring.ignoreOnClusterForReplicated = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server makes ON CLUSTER a no-op instead of failing
+			require.NoError(t, ignoring.checkStatement(tt.query))
+
+			err := s.checkStatement(tt.query)
+			if !tt.wantErr {
+				require.NoError(t, err)
+
+				return
+			}
+			var featureErr *UnsupportedFeatureError
+			require.ErrorAs(t, err, &featureErr)
+			require.Equal(t, "ON CLUSTER", featureErr.Feature)
+			require.Contains(t, err.Error(), "ON CLUSTER is not supported")
+		})
+	}
+}
+
+func TestClickhouse_NewUser_unsupportedFeature(t *testing.T) {
+	db := newClickhouse(DefaultUserNameTemplate)
+	defer db.Close()
+	_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{"connection_url": "tcp://127.0.0.1:1"},
+	})
+	require.NoError(t, err)
+	version, err := parseServerVersion("23.3.1.1")
+	require.NoError(t, err)
+	db.capabilities = &serverCapabilities{version: version}
+
+	// Nothing is sent to the server, so the unreachable host does not matter
+	_, err = db.NewUser(t.Context(), dbplugin.NewUserRequest{
+		Statements: dbplugin.Statements{Commands: []string{
+			"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; ALTER USER '{{name}}' VALID UNTIL '{{expiration}}'",
+		}},
+		Password: "09g8hanbdfkVSM",
+	})
+	var stmtErr *StatementError
+	require.ErrorAs(t, err, &stmtErr)
+	require.Equal(t, 1, stmtErr.Index)
+	var featureErr *UnsupportedFeatureError
+	require.ErrorAs(t, err, &featureErr)
+	require.Equal(t, "VALID UNTIL", featureErr.Feature)
+}
@@ -5,9 +5,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
+	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-secure-stdlib/strutil"
 	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
 	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
@@ -24,6 +28,13 @@ const (
 		ALTER USER IF EXISTS '{{name}}' IDENTIFIED BY '{{password}}';
 	`
 	clickhouseTypeName = "clickhouse"
+	// clickhouseDateTimeFormat is a DateTime literal with its offset, as
+	// parsed by parseDateTimeBestEffort
+	clickhouseDateTimeFormat = "2006-01-02 15:04:05-07:00"
+
+	// maxUsernameAttempts bounds the usernames generated by NewUser when
+	// the generated ones already exist
+	maxUsernameAttempts = 5
 
 	DefaultUserNameTemplate = `{{ printf "v-%s-%s-%s-%s" (.DisplayName | truncate 10) (.RoleName | truncate 10) (random 20) (unix_time) | truncate 32 }}`
 )
@@ -48,24 +59,45 @@ func (c *Clickhouse) PluginVersion() logical.PluginVersion {
 	}
 }
 
-// New implements builtinplugins.BuiltinFactory
-func New(defaultUsernameTemplate string, version string) func() (interface{}, error) {
+// Option customizes the Clickhouse plugin built by New
+type Option func(*Clickhouse)
+
+// WithLogger sets the logger of the plugin, logs are discarded by default
+func WithLogger(logger hclog.Logger) Option {
+	return func(c *Clickhouse) {
+		c.logger = logger
+	}
+}
+
+// New implements builtinplugins.BuiltinFactory. An empty version, e.g. when
+// not set with -ldflags, falls back to the version of the module in the Go
+// build info.
+func New(defaultUsernameTemplate string, version string, opts ...Option) func() (interface{}, error) {
 	return func() (interface{}, error) {
 		if defaultUsernameTemplate == "" {
 			return nil, errors.New("missing default username template")
 		}
+		pluginVersion := version
+		if pluginVersion == "" {
+			pluginVersion = ReadBuildInfo().Version
+		} else if err := validatePluginVersion(pluginVersion); err != nil {
+			return nil, err
+		}
 		db := newClickhouse(defaultUsernameTemplate)
-		// Wrap the plugin with middleware to sanitize errors
-		dbType := dbplugin.NewDatabaseErrorSanitizerMiddleware(db, db.SecretValues)
-
-		db.version = version
+		for _, opt := range opts {
+			opt(db)
+		}
+		db.version = pluginVersion
 
-		return dbType, nil
+		// Wrap the plugin with middleware to sanitize errors
+		return &errorSanitizerMiddleware{next: db}, nil
 	}
 }
 
 func newClickhouse(defaultUsernameTemplate string) *Clickhouse {
-	connProducer := &clickhouseConnectionProducer{}
+	connProducer := &clickhouseConnectionProducer{
+		logger: hclog.NewNullLogger(),
+	}
 
 	return &Clickhouse{
 		clickhouseConnectionProducer: connProducer,
@@ -87,6 +119,14 @@ func (c *Clickhouse) getConnection(ctx context.Context) (*sql.DB, error) {
 }
 
 func (c *Clickhouse) Initialize(ctx context.Context, req dbplugin.InitializeRequest) (dbplugin.InitializeResponse, error) {
+	ctx, span := startOperationSpan(ctx, operationInitialize)
+	resp, err := c.initialize(ctx, req)
+	endSpan(span, err, c.sanitize(err, nil))
+
+	return resp, err
+}
+
+func (c *Clickhouse) initialize(ctx context.Context, req dbplugin.InitializeRequest) (dbplugin.InitializeResponse, error) {
 	usernameTemplate, err := strutil.GetString(req.Config, "username_template")
 	if err != nil {
 		return dbplugin.InitializeResponse{}, err
@@ -96,7 +136,8 @@ func (c *Clickhouse) Initialize(ctx context.Context, req dbplugin.InitializeRequ
 		usernameTemplate = c.defaultUsernameTemplate
 	}
 
-	up, err := template.NewTemplate(template.Template(usernameTemplate))
+	opts := append([]template.Opt{template.Template(usernameTemplate)}, c.usernameTemplateFuncs()...)
+	up, err := template.NewTemplate(opts...)
 	if err != nil {
 		return dbplugin.InitializeResponse{}, fmt.Errorf("unable to initialize username template: %w", err)
 	}
@@ -110,8 +151,11 @@ func (c *Clickhouse) Initialize(ctx context.Context, req dbplugin.InitializeRequ
 
 	err = c.clickhouseConnectionProducer.Initialize(ctx, req.Config, req.VerifyConnection)
 	if err != nil {
+		c.logger.Error("initialization failed", "verify_connection", req.VerifyConnection, "error", c.sanitize(err, nil))
+
 		return dbplugin.InitializeResponse{}, err
 	}
+	c.logger.Info("initialized", "host", c.addr, "verify_connection", req.VerifyConnection)
 
 	resp := dbplugin.InitializeResponse{
 		Config: req.Config,
@@ -121,72 +165,191 @@ func (c *Clickhouse) Initialize(ctx context.Context, req dbplugin.InitializeRequ
 }
 
 func (c *Clickhouse) NewUser(ctx context.Context, req dbplugin.NewUserRequest) (dbplugin.NewUserResponse, error) {
+	ctx, span := startOperationSpan(ctx, operationNewUser, attrRole.String(req.UsernameConfig.RoleName))
+	start := time.Now()
+	resp, err := c.newUser(ctx, req)
+	emitOperationMetrics(operationNewUser, start, err)
+	endSpan(span, err, c.sanitize(err, map[string]string{"password": req.Password}))
+
+	return resp, err
+}
+
+// newUser creates the user of req. A generated username that already exists
+// is regenerated, up to maxUsernameAttempts times.
+func (c *Clickhouse) newUser(ctx context.Context, req dbplugin.NewUserRequest) (dbplugin.NewUserResponse, error) {
+	var err error
+	for attempt := 1; attempt <= maxUsernameAttempts; attempt++ {
+		username, statements, queryMap, genErr := c.newUserStatements(req)
+		if genErr != nil {
+			return dbplugin.NewUserResponse{}, genErr
+		}
+
+		err = c.executeStatementsWithMap(ctx, operationNewUser, statements, queryMap)
+		if err == nil {
+			resp := dbplugin.NewUserResponse{
+				Username: username,
+			}
+
+			return resp, nil
+		}
+		if !isUsernameCollision(err) {
+			return dbplugin.NewUserResponse{}, err
+		}
+		c.logger.Warn("generated username already exists", "username", username, "attempt", attempt)
+	}
+
+	return dbplugin.NewUserResponse{}, fmt.Errorf("no unique username generated after %d attempts: %w", maxUsernameAttempts, err)
+}
+
+// isUsernameCollision reports whether err is the first creation statement
+// failing because a user, and not another access entity, already exists.
+// Nothing ran before it, so the user can be created again under another name.
+func isUsernameCollision(err error) bool {
+	var stmtErr *StatementError
+
+	return errors.As(err, &stmtErr) && stmtErr.Index == 0 && errors.Is(err, ErrUserAlreadyExists)
+}
+
+// newUserStatements generates the username of req, and returns it with the
+// creation statements and the variables to render them with
+func (c *Clickhouse) newUserStatements(req dbplugin.NewUserRequest) (string, []string, map[string]string, error) {
 	if len(req.Statements.Commands) == 0 {
-		return dbplugin.NewUserResponse{}, dbutil.ErrEmptyCreationStatement
+		return "", nil, nil, dbutil.ErrEmptyCreationStatement
+	}
+
+	// Structured statements declare the resource limits of the user
+	if err := checkStructuredStatements(req.Statements.Commands, c.UserLimits); err != nil {
+		return "", nil, nil, err
+	}
+	statements, err := splitStructuredStatements(req.Statements.Commands, c.limitsCluster())
+	if err != nil {
+		return "", nil, nil, err
 	}
 
 	username, err := c.usernameProducer.Generate(req.UsernameConfig)
 	if err != nil {
-		return dbplugin.NewUserResponse{}, err
+		return "", nil, nil, err
 	}
 
 	password := req.Password
+	if err := c.validatePassword(password); err != nil {
+		return "", nil, nil, err
+	}
 
 	expirationStr := req.Expiration.Format("2006-01-02 15:04:05-0700")
 
+	// The display name comes from auth methods, both names are escaped to
+	// be interpolated in string literals
+	displayName := escapeStringLiteral(req.UsernameConfig.DisplayName)
+	roleName := escapeStringLiteral(req.UsernameConfig.RoleName)
+
 	queryMap := map[string]string{
-		"name":       username,
-		"username":   username,
-		"password":   password,
-		"expiration": expirationStr,
+		"name":         username,
+		"username":     username,
+		"password":     password,
+		"expiration":   expirationStr,
+		"display_name": displayName,
+		"role_name":    roleName,
+		"database":     c.database,
+		"cluster":      c.Cluster,
+		// The expiration as a unix timestamp, in RFC 3339, and as a UTC
+		// DateTime literal, e.g. for VALID UNTIL. The literal carries its
+		// offset, a zone-less one is read in the timezone of the server.
+		"expiration_unix":       strconv.FormatInt(req.Expiration.Unix(), 10),
+		"expiration_rfc3339":    req.Expiration.Format(time.RFC3339),
+		"expiration_clickhouse": req.Expiration.UTC().Format(clickhouseDateTimeFormat),
 	}
 
-	if err := c.executeStatementsWithMap(ctx, req.Statements.Commands, queryMap); err != nil {
-		return dbplugin.NewUserResponse{}, err
-	}
+	return username, statements, queryMap, nil
+}
 
-	resp := dbplugin.NewUserResponse{
-		Username: username,
+// limitsCluster is the cluster the limits of users run ON CLUSTER by default,
+// the configured one unless their access storage rejects ON CLUSTER
+func (c *Clickhouse) limitsCluster() string {
+	if c.capabilities.rejectsOnCluster(c.AccessStorage) {
+		return ""
 	}
 
-	return resp, nil
+	return c.Cluster
+}
+
+// escapeStringLiteral escapes str to be interpolated in a single quoted
+// ClickHouse string literal
+func escapeStringLiteral(str string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(str)
 }
 
 func (c *Clickhouse) DeleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
+	ctx, span := startOperationSpan(ctx, operationDeleteUser)
+	start := time.Now()
+	resp, err := c.deleteUser(ctx, req)
+	emitOperationMetrics(operationDeleteUser, start, err)
+	endSpan(span, err, c.sanitize(err, nil))
+
+	return resp, err
+}
+
+func (c *Clickhouse) deleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
+	revocationStmts, queryMap, err := c.deleteUserStatements(req)
+	if err != nil {
+		return dbplugin.DeleteUserResponse{}, err
+	}
+	if err = c.executeStatementsWithMap(ctx, operationDeleteUser, revocationStmts, queryMap); err != nil {
+		return dbplugin.DeleteUserResponse{}, err
+	}
+
+	return dbplugin.DeleteUserResponse{}, nil
+}
+
+// deleteUserStatements returns the revocation statements of req, the default
+// ones if unset, and the variables to render them with. With user limits
+// enabled, they are followed by the ones dropping the limits of the user.
+func (c *Clickhouse) deleteUserStatements(req dbplugin.DeleteUserRequest) ([]string, map[string]string, error) {
 	revocationStmts := req.Statements.Commands
 	if len(revocationStmts) == 0 {
 		revocationStmts = []string{defaultClickhouseRevocationStmts}
 	}
+	if err := checkStructuredStatements(revocationStmts, c.UserLimits); err != nil {
+		return nil, nil, err
+	}
+	if c.UserLimits {
+		var err error
+		if revocationStmts, err = splitStructuredRevocationStatements(revocationStmts, c.limitsCluster()); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	queryMap := map[string]string{
+	return revocationStmts, map[string]string{
 		"name":     req.Username,
 		"username": req.Username,
+	}, nil
+}
+
+func (c *Clickhouse) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
+	ctx, span := startOperationSpan(ctx, operationUpdateUser)
+	start := time.Now()
+	resp, err := c.updateUser(ctx, req)
+	emitOperationMetrics(operationUpdateUser, start, err)
+	queryMap := map[string]string{}
+	if req.Password != nil {
+		queryMap["password"] = req.Password.NewPassword
 	}
-	if err := c.executeStatementsWithMap(ctx, revocationStmts, queryMap); err != nil {
-		return dbplugin.DeleteUserResponse{}, err
-	}
+	endSpan(span, err, c.sanitize(err, queryMap))
 
-	return dbplugin.DeleteUserResponse{}, nil
+	return resp, err
 }
 
-func (c *Clickhouse) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
+func (c *Clickhouse) updateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
 	if req.Password == nil && req.Expiration == nil {
 		return dbplugin.UpdateUserResponse{}, errors.New("no change requested")
 	}
 
 	if req.Password != nil {
-		rotateStatments := req.Password.Statements.Commands
-		if len(rotateStatments) == 0 {
-			rotateStatments = []string{defaultClickhouseRotateCredentialsSQL}
-		}
-
-		queryMap := map[string]string{
-			"name":     req.Username,
-			"username": req.Username,
-			"password": req.Password.NewPassword,
+		if err := c.validatePassword(req.Password.NewPassword); err != nil {
+			return dbplugin.UpdateUserResponse{}, err
 		}
-
-		if err := c.executeStatementsWithMap(ctx, rotateStatments, queryMap); err != nil {
+		rotateStatments, queryMap := updatePasswordStatements(req.Username, req.Password)
+		if err := c.executeStatementsWithMap(ctx, operationUpdateUser, rotateStatments, queryMap); err != nil {
 			return dbplugin.UpdateUserResponse{}, err
 		}
 	}
@@ -196,20 +359,72 @@ func (c *Clickhouse) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequ
 	return dbplugin.UpdateUserResponse{}, nil
 }
 
+// updatePasswordStatements returns the rotation statements of password, the
+// default ones if unset, and the variables to render them with
+func updatePasswordStatements(username string, password *dbplugin.ChangePassword) ([]string, map[string]string) {
+	rotateStatments := password.Statements.Commands
+	if len(rotateStatments) == 0 {
+		rotateStatments = []string{defaultClickhouseRotateCredentialsSQL}
+	}
+
+	return rotateStatments, map[string]string{
+		"name":     username,
+		"username": username,
+		"password": password.NewPassword,
+	}
+}
+
 // executeStatementsWithMap loops through the given templated SQL statements and
 // applies the map to them, interpolating values into the templates, returning
-// the resulting username and password
-func (c *Clickhouse) executeStatementsWithMap(ctx context.Context, statements []string, queryMap map[string]string) error {
+// the resulting username and password. A failing statement is reported as a
+// *StatementError on behalf of operation.
+func (c *Clickhouse) executeStatementsWithMap(ctx context.Context, operation string, statements []string, queryMap map[string]string) error {
 	// Grab the lock
 	c.Lock()
 	defer c.Unlock()
 
+	// Bound the whole operation so a hung query cannot hold the lock forever
+	if c.operationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.operationTimeout)
+		defer cancel()
+	}
+
+	logger := c.logger.With("operation", operation, "host", c.addr)
+	start := time.Now()
+	logger.Debug("operation started")
+
 	// Get the connection
 	db, err := c.getConnection(ctx)
 	if err != nil {
+		logger.Error("unable to get a connection", "error", c.sanitize(err, queryMap))
+
+		return err
+	}
+	// Reject all the statements before running any if one needs a feature
+	// the server does not support
+	queries, err := c.renderStatements(operation, statements, queryMap)
+	if err != nil {
+		logger.Error("unsupported statement", "error", err)
+
 		return err
 	}
 	// Execute the statements
+	for index, query := range queries {
+		if err = c.runStatement(ctx, logger, db, operation, index, query, queryMap); err != nil {
+			return err
+		}
+	}
+	logger.Debug("operation finished", "statements", len(queries), "duration", time.Since(start))
+
+	return nil
+}
+
+// renderStatements splits the templated SQL statements into queries and
+// interpolates queryMap into them. A query needing a feature the server does
+// not support is reported as a *StatementError on behalf of operation.
+func (c *Clickhouse) renderStatements(operation string, statements []string, queryMap map[string]string) ([]string, error) {
+	var queries []string
 	for _, stmt := range statements {
 		for _, query := range strutil.ParseArbitraryStringSlice(stmt, ";") {
 			query = strings.TrimSpace(query)
@@ -217,11 +432,61 @@ func (c *Clickhouse) executeStatementsWithMap(ctx context.Context, statements []
 				continue
 			}
 			query = dbutil.QueryHelper(query, queryMap)
-			if _, err = db.ExecContext(ctx, query); err != nil {
-				return fmt.Errorf("unable to execute query. err=%v", err.Error())
+			query = withAccessStorage(query, c.AccessStorage)
+			if err := c.capabilities.checkStatement(query); err != nil {
+				return nil, &StatementError{Operation: operation, Index: len(queries), Err: err}
 			}
+			queries = append(queries, query)
 		}
 	}
 
+	return queries, nil
+}
+
+// runStatement executes query, the statement at index of operation, with
+// retries, in its own span. queryMap is only used to sanitize errors.
+func (c *Clickhouse) runStatement(ctx context.Context, logger hclog.Logger, db *sql.DB, operation string, index int, query string, queryMap map[string]string) error {
+	ctx, span := startStatementSpan(ctx, operation, index, query, c.addr)
+	start := time.Now()
+	err := c.retryPolicy.do(ctx, query, func() error {
+		return c.execStatement(ctx, db, query)
+	}, func(err error, wait time.Duration) {
+		logger.Warn("retrying statement", "statement", index, "wait", wait, "error", c.sanitize(err, queryMap))
+	})
+	if err != nil {
+		stmtErr := &StatementError{Operation: operation, Index: index, Err: err}
+		sanitized := c.sanitize(err, queryMap)
+		logger.Error("statement failed", "statement", index, "code", stmtErr.Code(),
+			"duration", time.Since(start), "error", sanitized)
+		endSpan(span, stmtErr, sanitized)
+
+		return stmtErr
+	}
+	logger.Trace("statement executed", "statement", index, "duration", time.Since(start))
+	endSpan(span, nil, "")
+
 	return nil
 }
+
+// execStatement runs a single query, bounded by the statement timeout both
+// client side and server side, and propagates the current span to ClickHouse.
+func (c *Clickhouse) execStatement(ctx context.Context, db *sql.DB, query string) error {
+	if c.statementTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.statementTimeout)
+		defer cancel()
+	}
+
+	settings := clickhouse.Settings{}
+	maps.Copy(settings, c.statementSettings())
+	opts := traceQueryOptions(ctx, settings)
+	if len(settings) > 0 {
+		opts = append(opts, clickhouse.WithSettings(settings))
+	}
+	if len(opts) > 0 {
+		ctx = clickhouse.Context(ctx, opts...)
+	}
+	_, err := db.ExecContext(ctx, query)
+
+	return err
+}
@@ -1,12 +1,17 @@
 package vault_plugin_database_clickhouse
 
 import (
+	"bytes"
 	"fmt"
+	"maps"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	clickhousehelper "github.com/contentsquare/vault-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
 	dbtesting "github.com/hashicorp/vault/sdk/database/dbplugin/v5/testing"
 	"github.com/stretchr/testify/require"
@@ -158,6 +163,55 @@ func testInitialize(t *testing.T, adminUser, adminPassword string) {
 	}
 }
 
+func TestClickhouse_Initialize_doesNotReturnSecrets(t *testing.T) {
+	const password = "p@ss w/rd&1"
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{
+			name: "Should return the connection_url as given",
+			config: map[string]interface{}{
+				"connection_url": "tcp://someHost:9000/someDatabase",
+				"username":       "admin",
+				"password":       password,
+				"tls":            true,
+				"dial_timeout":   "5s",
+			},
+		},
+		{
+			name: "Should return the connection_url as given when it carries driver options",
+			config: map[string]interface{}{
+				"connection_url": "tcp://someHost:9000?compress=lz4&read_timeout=10s",
+				"password":       password,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := maps.Clone(tt.config)
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+
+			// Initialize twice, as Vault does when the configuration is updated
+			for range 2 {
+				resp, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{Config: tt.config})
+				require.NoError(t, err)
+				require.Equal(t, want, resp.Config)
+				for key, value := range resp.Config {
+					if key == "password" {
+						continue
+					}
+					str := fmt.Sprint(value)
+					require.NotContains(t, str, db.connectionString, key)
+					require.NotContains(t, str, url.QueryEscape(password), key)
+				}
+			}
+			require.Contains(t, db.connectionString, url.QueryEscape(password))
+		})
+	}
+}
+
 func TestClickhouse_NewUser(t *testing.T) {
 	displayName := "token"
 	roleName := "testrole"
@@ -168,12 +222,71 @@ func TestClickhouse_NewUser(t *testing.T) {
 		newUserReq dbplugin.NewUserRequest
 
 		useSSL bool
+		// minVersion is the first server version supporting the statements
+		minVersion string
 
 		expectedUsernameRegex string
 		expectErr             bool
 	}
 
 	tests := map[string]testCase{
+		"valid until statements": {
+			newUserReq: dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{
+					DisplayName: displayName,
+					RoleName:    roleName,
+				},
+				Statements: dbplugin.Statements{
+					Commands: []string{
+						`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration}}';`,
+					},
+				},
+				Password:   "09g8hanbdfkVSM",
+				Expiration: time.Now().Add(time.Minute),
+			},
+			minVersion: "23.9",
+
+			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
+			expectErr:             false,
+		},
+		"valid until statements in ClickHouse format": {
+			newUserReq: dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{
+					DisplayName: displayName,
+					RoleName:    roleName,
+				},
+				Statements: dbplugin.Statements{
+					Commands: []string{
+						`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration_clickhouse}}';`,
+					},
+				},
+				Password:   "09g8hanbdfkVSM",
+				Expiration: time.Now().Add(time.Minute),
+			},
+			minVersion: "23.9",
+
+			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
+			expectErr:             false,
+		},
+		"bcrypt statements": {
+			newUserReq: dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{
+					DisplayName: displayName,
+					RoleName:    roleName,
+				},
+				Statements: dbplugin.Statements{
+					Commands: []string{
+						`CREATE USER '{{name}}' IDENTIFIED WITH bcrypt_password BY '{{password}}';`,
+					},
+				},
+				Password:   "09g8hanbdfkVSM",
+				Expiration: time.Now().Add(time.Minute),
+			},
+			minVersion: "23.5",
+
+			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
+			expectErr:             false,
+		},
 		"name statements": {
 			newUserReq: dbplugin.NewUserRequest{
 				UsernameConfig: dbplugin.UsernameMetadata{
@@ -193,28 +306,26 @@ func TestClickhouse_NewUser(t *testing.T) {
 			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
 			expectErr:             false,
 		},
-		//nolint
-		//TODO: Debug why SSL does not work and re-enable this test
-		// "name statements with SSL": {
-		// 	useSSL: true,
-		// 	newUserReq: dbplugin.NewUserRequest{
-		// 		UsernameConfig: dbplugin.UsernameMetadata{
-		// 			DisplayName: displayName,
-		// 			RoleName:    roleName,
-		// 		},
-		// 		Statements: dbplugin.Statements{
-		// 			Commands: []string{
-		// 				`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}';
-		// 				GRANT SELECT ON *.* TO '{{name}}';`,
-		// 			},
-		// 		},
-		// 		Password:   "09g8hanbdfkVSM",
-		// 		Expiration: time.Now().Add(time.Minute),
-		// 	},
-		//
-		// 	expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
-		// 	expectErr:             false,
-		// },
+		"name statements with SSL": {
+			useSSL: true,
+			newUserReq: dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{
+					DisplayName: displayName,
+					RoleName:    roleName,
+				},
+				Statements: dbplugin.Statements{
+					Commands: []string{
+						`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}';
+						GRANT SELECT ON *.* TO '{{name}}';`,
+					},
+				},
+				Password:   "09g8hanbdfkVSM",
+				Expiration: time.Now().Add(time.Minute),
+			},
+
+			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
+			expectErr:             false,
+		},
 		"username statements": {
 			newUserReq: dbplugin.NewUserRequest{
 				UsernameConfig: dbplugin.UsernameMetadata{
@@ -234,6 +345,25 @@ func TestClickhouse_NewUser(t *testing.T) {
 			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
 			expectErr:             false,
 		},
+		"structured statements with limits": {
+			newUserReq: dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{
+					DisplayName: displayName,
+					RoleName:    roleName,
+				},
+				Statements: dbplugin.Statements{
+					Commands: []string{
+						`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}';`,
+						`{"settings": {"max_memory_usage": 10000000000}, "quotas": [{"interval": "1 hour", "limits": {"queries": 100}}]}`,
+					},
+				},
+				Password:   "09g8hanbdfkVSM",
+				Expiration: time.Now().Add(time.Minute),
+			},
+
+			expectedUsernameRegex: `^v-token-testrole-[a-zA-Z0-9]{15}$`,
+			expectErr:             false,
+		},
 		"custom username template": {
 			usernameTemplate: "foo-{{random 10}}-{{.RoleName | uppercase}}",
 
@@ -261,10 +391,14 @@ func TestClickhouse_NewUser(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			cleanup, connURL := clickhousehelper.PrepareTestContainer(t, test.useSSL, "admin_user", "secret")
 			defer cleanup()
+			if test.minVersion != "" {
+				clickhousehelper.RequireVersion(t, connURL, test.minVersion)
+			}
 
 			connectionDetails := map[string]interface{}{
 				"connection_url":    connURL,
 				"username_template": test.usernameTemplate,
+				"user_limits":       true,
 			}
 
 			initReq := dbplugin.InitializeRequest{
@@ -534,6 +668,87 @@ func TestClickhouse_UpdateUser(t *testing.T) {
 	}
 }
 
+func TestClickhouse_TLS(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          clickhousehelper.TLSMode
+		withCA        bool
+		withClientKey bool
+		expectErr     string
+	}{
+		{
+			name:   "Should verify the server certificate against tls_ca",
+			mode:   clickhousehelper.TLSEnabled,
+			withCA: true,
+		},
+		{
+			name:      "Should reject a server certificate signed by an unknown CA",
+			mode:      clickhousehelper.TLSEnabled,
+			expectErr: "certificate signed by unknown authority",
+		},
+		{
+			name:          "Should present the client certificate to a server requiring one",
+			mode:          clickhousehelper.TLSMutual,
+			withCA:        true,
+			withClientKey: true,
+		},
+		{
+			name:      "Should fail to connect to a server requiring a client certificate without one",
+			mode:      clickhousehelper.TLSMutual,
+			withCA:    true,
+			expectErr: "error verifying - ping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleanup, container := clickhousehelper.StartTestContainer(t, clickhousehelper.ContainerOptions{
+				AdminUser:     "admin_user",
+				AdminPassword: "secret",
+				TLS:           tt.mode,
+			})
+			defer cleanup()
+			if container.TLS == nil {
+				t.Skip("the TLS material of the CLICKHOUSE_URL server is unknown")
+			}
+
+			config := map[string]interface{}{"connection_url": container.URL}
+			if tt.withCA {
+				config["tls_ca"] = string(container.TLS.CA)
+			}
+			if tt.withClientKey {
+				config["tls_certificate"] = string(container.TLS.ClientCertificate)
+				config["tls_private_key"] = string(container.TLS.ClientPrivateKey)
+			}
+
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{Config: config, VerifyConnection: true})
+			if tt.expectErr != "" {
+				require.ErrorContains(t, err, tt.expectErr)
+
+				return
+			}
+			require.NoError(t, err)
+
+			userResp, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "tls"},
+				Statements:     dbplugin.Statements{Commands: []string{`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}';`}},
+				Password:       "09g8hanbdfkVSM",
+				Expiration:     time.Now().Add(time.Minute),
+			})
+			require.NoError(t, err)
+
+			connURLBuilder, err := NewConnStringBuilderFromConnString(container.URL)
+			require.NoError(t, err)
+			userURL, err := connURLBuilder.WithUsername(userResp.Username).WithPassword("09g8hanbdfkVSM").BuildConnectionString()
+			require.NoError(t, err)
+			tlsConfig, err := container.TLS.ClientTLSConfig(tt.withClientKey)
+			require.NoError(t, err)
+			require.NoError(t, clickhousehelper.TestCredsExistTLS(t, userURL, tlsConfig))
+		})
+	}
+}
+
 func TestNew(t *testing.T) {
 	type args struct {
 		defaultUsernameTemplate string
@@ -562,8 +777,8 @@ func TestNew(t *testing.T) {
 			if err != nil {
 				t.Fatalf("error calling New(): error = %v", err.Error())
 			}
-			if got, ok := gotInterface.(dbplugin.DatabaseErrorSanitizerMiddleware); !ok {
-				t.Errorf("New() result interface is not dbplugin.DatabaseErrorSanitizerMiddleware")
+			if got, ok := gotInterface.(*errorSanitizerMiddleware); !ok {
+				t.Errorf("New() result interface is not *errorSanitizerMiddleware")
 			} else {
 				if got.PluginVersion().Version != tt.wantPlugInVersion {
 					t.Errorf("New() Plugin version error. got=%s, want=%s", got.PluginVersion().Version, tt.wantPlugInVersion)
@@ -576,3 +791,655 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkClickhouse_NewUser(b *testing.B) {
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(b, false, "admin_user", "secret")
+	defer cleanup()
+
+	newUserReq := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{
+			DisplayName: "token",
+			RoleName:    "benchrole",
+		},
+		Statements: dbplugin.Statements{
+			Commands: []string{
+				`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}';`,
+			},
+		},
+		Password:   "09g8hanbdfkVSM",
+		Expiration: time.Now().Add(time.Minute),
+	}
+
+	benchmarks := map[string]string{
+		// a zero interval pings the database on every Connection call
+		"ping on every call":    "0s",
+		"default health checks": defaultHealthCheckInterval,
+		"hourly health checks":  "1h",
+	}
+	for name, healthCheckInterval := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+			_, err := db.Initialize(b.Context(), dbplugin.InitializeRequest{
+				Config: map[string]interface{}{
+					"connection_url":        connURL,
+					"health_check_interval": healthCheckInterval,
+				},
+				VerifyConnection: true,
+			})
+			require.NoError(b, err)
+
+			for b.Loop() {
+				if _, err := db.NewUser(b.Context(), newUserReq); err != nil {
+					b.Fatalf("no error expected, got: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestClickhouse_NewUser_statementVariables(t *testing.T) {
+	expiration := time.Date(2024, 3, 1, 14, 30, 0, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		name        string
+		config      map[string]interface{}
+		displayName string
+		creation    string
+		want        string
+	}{
+		{
+			name:     "Should render the username metadata",
+			creation: "CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' COMMENT '{{display_name}} for {{role_name}}'",
+			want:     "CREATE USER 'v_reader' IDENTIFIED BY '09g8hanbdfkVSM' COMMENT 'token-john for reader'",
+		},
+		{
+			name:        "Should escape the username metadata",
+			displayName: `oidc-o'brien\`,
+			creation:    "CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' COMMENT '{{display_name}}'",
+			want:        `CREATE USER 'v_reader' IDENTIFIED BY '09g8hanbdfkVSM' COMMENT 'oidc-o\'brien\\'`,
+		},
+		{
+			name:     "Should render the cluster and database settings",
+			config:   map[string]interface{}{"cluster": "main", "database": "analytics"},
+			creation: "CREATE USER '{{name}}' ON CLUSTER '{{cluster}}' IDENTIFIED BY '{{password}}' DEFAULT DATABASE {{database}}",
+			want:     "CREATE USER 'v_reader' ON CLUSTER 'main' IDENTIFIED BY '09g8hanbdfkVSM' DEFAULT DATABASE analytics",
+		},
+		{
+			name:     "Should render the expiration in ClickHouse format",
+			creation: "CREATE USER '{{name}}' IDENTIFIED BY '{{password}}' VALID UNTIL '{{expiration_clickhouse}}'",
+			want:     "CREATE USER 'v_reader' IDENTIFIED BY '09g8hanbdfkVSM' VALID UNTIL '2024-03-01 13:30:00+00:00'",
+		},
+		{
+			name:     "Should render the expiration as a timestamp and in RFC 3339",
+			creation: "CREATE USER '{{name}}' SETTINGS custom_expires_at = {{expiration_unix}} COMMENT '{{expiration_rfc3339}}'",
+			want:     "CREATE USER 'v_reader' SETTINGS custom_expires_at = 1709299800 COMMENT '2024-03-01T14:30:00+01:00'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+			config := map[string]interface{}{
+				"connection_url":    "tcp://127.0.0.1:1",
+				"username_template": "v_{{ .RoleName }}",
+			}
+			maps.Copy(config, tt.config)
+			// Nothing is sent to the server, so the unreachable host does not matter
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{Config: config})
+			require.NoError(t, err)
+
+			displayName := tt.displayName
+			if displayName == "" {
+				displayName = "token-john"
+			}
+			username, statements, queryMap, err := db.newUserStatements(dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{DisplayName: displayName, RoleName: "reader"},
+				Statements:     dbplugin.Statements{Commands: []string{tt.creation}},
+				Password:       "09g8hanbdfkVSM",
+				Expiration:     expiration,
+			})
+			require.NoError(t, err)
+			require.Equal(t, "v_reader", username)
+			queries, err := db.renderStatements(operationNewUser, statements, queryMap)
+			require.NoError(t, err)
+			require.Equal(t, []string{tt.want}, queries)
+		})
+	}
+}
+
+func newFakeServerClickhouse(t *testing.T, config map[string]interface{}) (*Clickhouse, *clickhousehelper.FakeServer) {
+	t.Helper()
+
+	srv := clickhousehelper.StartFakeServer(t, "admin", "secret")
+	conf := map[string]interface{}{
+		"connection_url":         srv.URL(),
+		"retry_initial_interval": "1ms",
+		"retry_max_interval":     "1ms",
+	}
+	maps.Copy(conf, config)
+	db := newClickhouse(DefaultUserNameTemplate)
+	t.Cleanup(func() {
+		db.Close() //nolint:gosec
+	})
+	_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{
+		Config:           conf,
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+
+	return db, srv
+}
+
+func TestClickhouse_fakeServer(t *testing.T) {
+	db, srv := newFakeServerClickhouse(t, map[string]interface{}{"statement_timeout": "10s"})
+
+	newUserResp, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+		Statements: dbplugin.Statements{Commands: []string{
+			`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT readonly TO '{{name}}';`,
+		}},
+		Password:   "09g8hanbdfkVSM",
+		Expiration: time.Now().Add(time.Minute),
+	})
+	require.NoError(t, err)
+	username := newUserResp.Username
+	require.Equal(t, map[string]string{username: "09g8hanbdfkVSM"}, srv.Users())
+	require.NoError(t, clickhousehelper.TestCredsExist(t, srv.UserURL(username, "09g8hanbdfkVSM")))
+
+	queries := srv.Queries()
+	grant := queries[len(queries)-1]
+	require.Equal(t, "GRANT readonly TO '"+username+"'", grant.Body)
+	require.Equal(t, "admin", grant.User)
+	// The driver derives max_execution_time from the context deadline
+	require.Equal(t, "10", grant.Settings["distributed_ddl_task_timeout"])
+
+	_, err = db.UpdateUser(t.Context(), dbplugin.UpdateUserRequest{
+		Username: username,
+		Password: &dbplugin.ChangePassword{NewPassword: "newPassword1234"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{username: "newPassword1234"}, srv.Users())
+	require.Error(t, clickhousehelper.TestCredsExist(t, srv.UserURL(username, "09g8hanbdfkVSM")))
+
+	_, err = db.DeleteUser(t.Context(), dbplugin.DeleteUserRequest{Username: username})
+	require.NoError(t, err)
+	require.Empty(t, srv.Users())
+	require.Equal(t, "DROP USER IF EXISTS '"+username+"'", srv.Statements()[len(srv.Statements())-1])
+}
+
+func TestClickhouse_fakeServer_userLimits(t *testing.T) {
+	db, srv := newFakeServerClickhouse(t, map[string]interface{}{"cluster": "main", "user_limits": true})
+
+	newUserResp, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+		Statements: dbplugin.Statements{Commands: []string{
+			`CREATE USER '{{name}}' ON CLUSTER '{{cluster}}' IDENTIFIED BY '{{password}}'`,
+			`{"settings": {"readonly": 2}}`,
+		}},
+		Password:   "09g8hanbdfkVSM",
+		Expiration: time.Now().Add(time.Minute),
+	})
+	require.NoError(t, err)
+	username := newUserResp.Username
+	require.Contains(t, srv.Statements(), "CREATE SETTINGS PROFILE '"+username+"_profile' ON CLUSTER 'main' SETTINGS readonly = 2 TO '"+username+"'")
+
+	_, err = db.DeleteUser(t.Context(), dbplugin.DeleteUserRequest{Username: username})
+	require.NoError(t, err)
+	statements := srv.Statements()
+	require.Equal(t, []string{
+		"DROP USER IF EXISTS '" + username + "'",
+		"DROP SETTINGS PROFILE IF EXISTS '" + username + "_profile' ON CLUSTER 'main'",
+		"DROP QUOTA IF EXISTS '" + username + "_quota' ON CLUSTER 'main'",
+	}, statements[len(statements)-3:])
+}
+
+func TestClickhouse_fakeServer_userLimitsDisabled(t *testing.T) {
+	db, srv := newFakeServerClickhouse(t, nil)
+
+	_, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+		Statements: dbplugin.Statements{Commands: []string{
+			`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'`,
+			`{"settings": {"readonly": 2}}`,
+		}},
+		Password:   "09g8hanbdfkVSM",
+		Expiration: time.Now().Add(time.Minute),
+	})
+	require.ErrorContains(t, err, "need user_limits to be enabled")
+	require.Empty(t, srv.Users())
+}
+
+func TestClickhouse_fakeServer_replicatedOnCluster(t *testing.T) {
+	tests := []struct {
+		name        string
+		ignoreValue string
+		wantErr     bool
+	}{
+		{
+			name:        "Should reject ON CLUSTER on the replicated access storage",
+			ignoreValue: "false",
+			wantErr:     true,
+		},
+		{
+			name:        "Should accept ON CLUSTER when the server ignores it for replicated access entities",
+			ignoreValue: "true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := clickhousehelper.StartFakeServer(t, "admin", "secret")
+			srv.Handle(`system\.user_directories`, func(string) (*clickhousehelper.FakeResult, error) {
+				return &clickhousehelper.FakeResult{Columns: []clickhousehelper.FakeColumn{
+					{Name: "name", Type: "String", Values: []interface{}{"users_xml", "replicated"}},
+					{Name: "type", Type: "String", Values: []interface{}{"users_xml", "replicated"}},
+				}}, nil
+			})
+			srv.Handle(`system\.server_settings`, func(string) (*clickhousehelper.FakeResult, error) {
+				return &clickhousehelper.FakeResult{Columns: []clickhousehelper.FakeColumn{
+					{Name: "value", Type: "String", Values: []interface{}{tt.ignoreValue}},
+				}}, nil
+			})
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+			// The cluster of a replicated access storage is still valid
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{
+				Config:           map[string]interface{}{"connection_url": srv.URL(), "cluster": "default"},
+				VerifyConnection: true,
+			})
+			require.NoError(t, err)
+
+			_, err = db.NewUser(t.Context(), dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+				Statements: dbplugin.Statements{Commands: []string{
+					`CREATE USER '{{name}}' ON CLUSTER '{{cluster}}' IDENTIFIED BY '{{password}}'`,
+				}},
+				Password:   "09g8hanbdfkVSM",
+				Expiration: time.Now().Add(time.Minute),
+			})
+			if !tt.wantErr {
+				require.NoError(t, err)
+
+				return
+			}
+			var featureErr *UnsupportedFeatureError
+			require.ErrorAs(t, err, &featureErr)
+			require.Equal(t, "ON CLUSTER", featureErr.Feature)
+			require.Empty(t, srv.Users())
+		})
+	}
+}
+
+func TestClickhouse_fakeServer_errors(t *testing.T) {
+	newUserReq := dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+		Statements: dbplugin.Statements{Commands: []string{
+			`CREATE USER IF NOT EXISTS '{{name}}' IDENTIFIED BY '{{password}}'; GRANT readonly TO '{{name}}';`,
+		}},
+		Password:   "09g8hanbdfkVSM",
+		Expiration: time.Now().Add(time.Minute),
+	}
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		fail       func(srv *clickhousehelper.FakeServer)
+		wantErr    error
+		wantCode   int32
+		wantUsers  int
+		wantGrants int
+	}{
+		{
+			name: "Should match the sentinel error of an exception",
+			fail: func(srv *clickhousehelper.FakeServer) {
+				srv.Fail("GRANT", codeUnknownRole, "There is no role `readonly` in user directories", 1)
+			},
+			wantErr:   ErrUnknownRole,
+			wantCode:  codeUnknownRole,
+			wantUsers: 1,
+		},
+		{
+			name: "Should retry an idempotent statement failing with a transient exception",
+			fail: func(srv *clickhousehelper.FakeServer) {
+				srv.Fail("CREATE USER", codeKeeperException, "Coordination::Exception: Connection loss", 2)
+			},
+			wantUsers:  1,
+			wantGrants: 1,
+		},
+		{
+			name:   "Should give up retrying when retries are disabled",
+			config: map[string]interface{}{"retry_max_elapsed_time": "0s"},
+			fail: func(srv *clickhousehelper.FakeServer) {
+				srv.Fail("CREATE USER", codeKeeperException, "Coordination::Exception: Connection loss", 1)
+			},
+			wantCode: codeKeeperException,
+		},
+		{
+			name: "Should not retry a statement that is not idempotent",
+			fail: func(srv *clickhousehelper.FakeServer) {
+				srv.Fail("GRANT", codeKeeperException, "Coordination::Exception: Connection loss", 1)
+			},
+			wantCode:  codeKeeperException,
+			wantUsers: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, srv := newFakeServerClickhouse(t, tt.config)
+			tt.fail(srv)
+
+			_, err := db.NewUser(t.Context(), newUserReq)
+			if tt.wantErr == nil && tt.wantCode == 0 {
+				require.NoError(t, err)
+			} else {
+				var stmtErr *StatementError
+				require.ErrorAs(t, err, &stmtErr)
+				require.Equal(t, tt.wantCode, stmtErr.Code())
+				if tt.wantErr != nil {
+					require.ErrorIs(t, err, tt.wantErr)
+				}
+			}
+			require.Len(t, srv.Users(), tt.wantUsers)
+			grants := 0
+			for _, stmt := range srv.Statements() {
+				if strings.HasPrefix(stmt, "GRANT") {
+					grants++
+				}
+			}
+			require.GreaterOrEqual(t, grants, tt.wantGrants)
+		})
+	}
+}
+
+func TestClickhouse_fakeServer_logging(t *testing.T) {
+	password := "09g8hanbdfkVSM"
+	srv := clickhousehelper.StartFakeServer(t, "admin", "secret")
+	var buf bytes.Buffer
+	db := newClickhouse(DefaultUserNameTemplate)
+	WithLogger(hclog.New(&hclog.LoggerOptions{Output: &buf, Level: hclog.Trace}))(db)
+	defer db.Close()
+	_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url":         srv.URL(),
+			"retry_initial_interval": "1ms",
+			"retry_max_interval":     "1ms",
+		},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	// Exceptions echoing the secrets, as some ClickHouse messages do
+	leak := fmt.Sprintf("password %s of %s", password, srv.URL())
+	srv.Fail("CREATE USER", codeKeeperException, "Coordination::Exception: Connection loss, "+leak, 1)
+	srv.Fail("GRANT", codeUnknownRole, "There is no role `readonly` in user directories, "+leak, 1)
+
+	_, err = db.NewUser(t.Context(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+		Statements: dbplugin.Statements{Commands: []string{
+			`CREATE USER IF NOT EXISTS '{{name}}' IDENTIFIED BY '{{password}}'; GRANT readonly TO '{{name}}';`,
+		}},
+		Password:   password,
+		Expiration: time.Now().Add(time.Minute),
+	})
+	require.ErrorIs(t, err, ErrUnknownRole)
+
+	logs := buf.String()
+	require.Contains(t, logs, "retrying statement")
+	require.Contains(t, logs, "statement failed")
+	require.Contains(t, logs, "statement=1")
+	require.Contains(t, logs, fmt.Sprintf("code=%d", codeUnknownRole))
+	require.Contains(t, logs, "[password]")
+	require.NotContains(t, logs, password)
+	require.NotContains(t, logs, "secret")
+	require.NotContains(t, logs, srv.URL())
+}
+
+func TestNew_sanitizedErrors(t *testing.T) {
+	password := "09g8hanbdfkVSM"
+	srv := clickhousehelper.StartFakeServer(t, "admin", "s3cr3t-adm1n")
+	got, err := New(DefaultUserNameTemplate, "v0.0.0-test")()
+	require.NoError(t, err)
+	db := got.(dbplugin.Database)
+	defer db.Close() //nolint:errcheck
+	_, err = db.Initialize(t.Context(), dbplugin.InitializeRequest{
+		Config:           map[string]interface{}{"connection_url": srv.URL()},
+		VerifyConnection: true,
+	})
+	require.NoError(t, err)
+	// An exception echoing the secrets, as some ClickHouse messages do
+	srv.Fail("GRANT", codeUnknownRole, fmt.Sprintf("There is no role `readonly`, password %s of %s", password, srv.URL()), 1)
+
+	_, err = db.NewUser(t.Context(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "testrole"},
+		Statements: dbplugin.Statements{Commands: []string{
+			`CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT readonly TO '{{name}}';`,
+		}},
+		Password:   password,
+		Expiration: time.Now().Add(time.Minute),
+	})
+	require.ErrorIs(t, err, ErrUnknownRole)
+	var stmtErr *StatementError
+	require.ErrorAs(t, err, &stmtErr)
+	require.Equal(t, 1, stmtErr.Index)
+	var exception *clickhouse.Exception
+	require.ErrorAs(t, err, &exception)
+	require.Equal(t, codeUnknownRole, exception.Code)
+	for _, secret := range []string{password, "s3cr3t-adm1n", srv.URL()} {
+		require.NotContains(t, err.Error(), secret)
+		require.NotContains(t, stmtErr.Error(), secret)
+		require.NotContains(t, exception.Message, secret)
+	}
+}
+
+func TestClickhouse_fakeServer_usernameCollision(t *testing.T) {
+	tests := []struct {
+		name             string
+		usernameTemplate string
+		creation         string
+		prepare          func(srv *clickhousehelper.FakeServer)
+		wantErr          error
+		wantCreations    int
+		wantUsers        int
+	}{
+		{
+			name:             "Should regenerate a username that already exists",
+			usernameTemplate: "v_{{ .RoleName }}_{{ random 4 }}",
+			creation:         `CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'`,
+			prepare: func(srv *clickhousehelper.FakeServer) {
+				srv.Fail("CREATE USER", codeAccessEntityAlreadyExists, "user `v_reader`: cannot insert because user `v_reader` already exists", 2)
+			},
+			wantCreations: 3,
+			wantUsers:     1,
+		},
+		{
+			name:             "Should fail once the attempts are exhausted",
+			usernameTemplate: "v_{{ .RoleName }}",
+			creation:         `CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'`,
+			prepare: func(srv *clickhousehelper.FakeServer) {
+				srv.AddUser("v_reader", "existing")
+			},
+			wantErr:       ErrUserAlreadyExists,
+			wantCreations: maxUsernameAttempts,
+			wantUsers:     1,
+		},
+		{
+			name:             "Should not regenerate the username when another access entity exists",
+			usernameTemplate: "v_{{ .RoleName }}_{{ random 4 }}",
+			creation:         `CREATE ROLE 'reader'; CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'`,
+			prepare: func(srv *clickhousehelper.FakeServer) {
+				srv.Fail("CREATE ROLE", codeAccessEntityAlreadyExists, "role `reader`: cannot insert because role `reader` already exists", 1)
+			},
+			wantErr:       ErrAccessEntityAlreadyExists,
+			wantCreations: 0,
+			wantUsers:     0,
+		},
+		{
+			name:             "Should not regenerate the username once a statement ran",
+			usernameTemplate: "v_{{ .RoleName }}",
+			creation:         `CREATE ROLE IF NOT EXISTS 'reader'; CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'`,
+			prepare: func(srv *clickhousehelper.FakeServer) {
+				srv.AddUser("v_reader", "existing")
+			},
+			wantErr:       ErrUserAlreadyExists,
+			wantCreations: 1,
+			wantUsers:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, srv := newFakeServerClickhouse(t, map[string]interface{}{"username_template": tt.usernameTemplate})
+			tt.prepare(srv)
+
+			resp, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "reader"},
+				Statements:     dbplugin.Statements{Commands: []string{tt.creation}},
+				Password:       "09g8hanbdfkVSM",
+				Expiration:     time.Now().Add(time.Minute),
+			})
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "09g8hanbdfkVSM", srv.Users()[resp.Username])
+			}
+			creations := 0
+			for _, stmt := range srv.Statements() {
+				if strings.HasPrefix(stmt, "CREATE USER") {
+					creations++
+				}
+			}
+			require.Equal(t, tt.wantCreations, creations)
+			require.Len(t, srv.Users(), tt.wantUsers)
+		})
+	}
+}
+
+func TestClickhouse_fakeServer_Initialize(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		config  map[string]interface{}
+		handle  func(srv *clickhousehelper.FakeServer)
+		wantErr string
+	}{
+		{
+			name:    "Should reject invalid admin credentials",
+			config:  map[string]interface{}{"password": "wrong"},
+			wantErr: "code: 516",
+		},
+		{
+			name: "Should report the missing privileges of the admin",
+			config: map[string]interface{}{
+				"cluster":         "default",
+				"grantable_roles": "readonly",
+			},
+			handle: func(srv *clickhousehelper.FakeServer) {
+				srv.Handle(`system\.grants`, func(string) (*clickhousehelper.FakeResult, error) {
+					return &clickhousehelper.FakeResult{Columns: []clickhousehelper.FakeColumn{
+						{Name: "access_type", Type: "String", Values: []interface{}{"CREATE USER", "DROP USER"}},
+					}}, nil
+				})
+			},
+			wantErr: "admin user admin is missing privileges: ALTER USER, ROLE ADMIN or ADMIN OPTION on role readonly, CLUSTER",
+		},
+		{
+			name:    "Should reject an access storage the server does not have",
+			config:  map[string]interface{}{"access_storage": "replicated"},
+			wantErr: "replicated not found in system.user_directories",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := clickhousehelper.StartFakeServer(t, "admin", "secret")
+			if tt.handle != nil {
+				tt.handle(srv)
+			}
+			conf := map[string]interface{}{"connection_url": srv.URL()}
+			maps.Copy(conf, tt.config)
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestClickhouse_cluster(t *testing.T) {
+	cleanup, cluster := clickhousehelper.PrepareTestCluster(t, 2, "admin_user", "secret")
+	defer cleanup()
+
+	tests := []struct {
+		name         string
+		config       map[string]interface{}
+		creation     string
+		rotation     string
+		revocation   string
+		replicatedAt time.Duration
+	}{
+		{
+			name:       "Should create, rotate and revoke the user on every node with ON CLUSTER",
+			config:     map[string]interface{}{"cluster": cluster.Name},
+			creation:   fmt.Sprintf(`CREATE USER '{{name}}' ON CLUSTER '%s' IDENTIFIED BY '{{password}}';`, cluster.Name),
+			rotation:   fmt.Sprintf(`ALTER USER '{{name}}' ON CLUSTER '%s' IDENTIFIED BY '{{password}}';`, cluster.Name),
+			revocation: fmt.Sprintf(`DROP USER IF EXISTS '{{name}}' ON CLUSTER '%s';`, cluster.Name),
+		},
+		{
+			name:         "Should create, rotate and revoke the user on every node with the replicated access storage",
+			config:       map[string]interface{}{"access_storage": "replicated"},
+			creation:     `CREATE USER '{{name}}' IDENTIFIED BY '{{password}}';`,
+			rotation:     `ALTER USER '{{name}}' IDENTIFIED BY '{{password}}';`,
+			revocation:   `DROP USER IF EXISTS '{{name}}';`,
+			replicatedAt: 10 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := map[string]interface{}{"connection_url": cluster.NodeURLs[0]}
+			maps.Copy(config, tt.config)
+
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{Config: config, VerifyConnection: true})
+			require.NoError(t, err)
+
+			// ON CLUSTER statements complete on every node before returning,
+			// the replicated storage converges through Keeper
+			requireCreds := func(username, password string, exist bool) {
+				t.Helper()
+				for _, nodeURL := range cluster.UserURLs(username, password) {
+					check := func() bool { return (clickhousehelper.TestCredsExist(t, nodeURL) == nil) == exist }
+					if tt.replicatedAt == 0 {
+						require.True(t, check(), "unexpected credentials state on %s", nodeURL)
+					} else {
+						require.Eventually(t, check, tt.replicatedAt, 100*time.Millisecond, "unexpected credentials state on %s", nodeURL)
+					}
+				}
+			}
+
+			userResp, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token", RoleName: "cluster"},
+				Statements:     dbplugin.Statements{Commands: []string{tt.creation}},
+				Password:       "09g8hanbdfkVSM",
+				Expiration:     time.Now().Add(time.Minute),
+			})
+			require.NoError(t, err)
+			requireCreds(userResp.Username, "09g8hanbdfkVSM", true)
+
+			_, err = db.UpdateUser(t.Context(), dbplugin.UpdateUserRequest{
+				Username: userResp.Username,
+				Password: &dbplugin.ChangePassword{
+					NewPassword: "y8fva_sdVA3rasf",
+					Statements:  dbplugin.Statements{Commands: []string{tt.rotation}},
+				},
+			})
+			require.NoError(t, err)
+			requireCreds(userResp.Username, "09g8hanbdfkVSM", false)
+			requireCreds(userResp.Username, "y8fva_sdVA3rasf", true)
+
+			_, err = db.DeleteUser(t.Context(), dbplugin.DeleteUserRequest{
+				Username:   userResp.Username,
+				Statements: dbplugin.Statements{Commands: []string{tt.revocation}},
+			})
+			require.NoError(t, err)
+			requireCreds(userResp.Username, "y8fva_sdVA3rasf", false)
+		})
+	}
+}
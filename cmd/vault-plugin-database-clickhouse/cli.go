@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	clickhouse "github.com/contentsquare/vault-plugin-database-clickhouse"
+	"github.com/hashicorp/go-secure-stdlib/base62"
+	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+)
+
+// command is a subcommand of the plugin binary, run from a shell rather than by Vault
+type command struct {
+	usage string
+	run   func(ctx context.Context, fs *flag.FlagSet, args []string, stdout io.Writer) error
+}
+
+func commands() map[string]command {
+	return map[string]command{
+		"check-connection": {
+			usage: "-config <file>\n\nConnect to ClickHouse, and check the server version, access storages and admin privileges.",
+			run:   checkConnection,
+		},
+		"render-statements": {
+			usage: "-config <file> [-operation create|update|delete] [-username <name>] [-display-name <name>] [-role-name <name>] [-password <password>] [-ttl <duration>] [statement...]\n\n" +
+				"Print the queries an operation runs, without running them. The password is masked unless given.",
+			run: renderStatements,
+		},
+		"create-user": {
+			usage: "-config <file> [-display-name <name>] [-role-name <name>] [-password <password>] [-ttl <duration>] statement...\n\n" +
+				"Create a user as Vault does for dynamic credentials, and print its credentials as JSON.",
+			run: createUser,
+		},
+		"revoke-user": {
+			usage: "-config <file> -username <name> [statement...]\n\nRevoke a user as Vault does when its lease expires.",
+			run:   revokeUser,
+		},
+		"list-managed-users": {
+			usage: "-config <file> [-prefix <prefix>]\n\nList the users whose name starts with the prefix of the username template.",
+			run:   listManagedUsers,
+		},
+		"version": {
+			usage: "\n\nPrint the version of the plugin and the commit it was built from.",
+			run: func(_ context.Context, fs *flag.FlagSet, args []string, stdout io.Writer) error {
+				if err := fs.Parse(args); err != nil {
+					return err
+				}
+				_, err := fmt.Fprintf(stdout, "%s %s\n", serviceName, buildInfo())
+
+				return err
+			},
+		},
+	}
+}
+
+// runCommand runs the subcommand name with args. The configuration file of
+// the subcommands is the JSON configuration of database/config/<name> in Vault.
+func runCommand(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+	cmd, ok := commands()[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: vault-plugin-database-clickhouse %s %s\n\n", name, cmd.usage) //nolint:errcheck
+		fs.PrintDefaults()
+	}
+
+	return cmd.run(ctx, fs, args, stdout)
+}
+
+func checkConnection(ctx context.Context, fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	configPath := fs.String("config", "", "plugin configuration file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	admin, err := newAdmin(ctx, *configPath, true)
+	if err != nil {
+		return err
+	}
+	defer admin.Close() //nolint:errcheck
+
+	return writeJSON(stdout, admin.Server())
+}
+
+func renderStatements(ctx context.Context, fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	configPath := fs.String("config", "", "plugin configuration file")
+	operation := fs.String("operation", "create", "operation: create, update or delete")
+	username := fs.String("username", "", "name of the user to update or delete")
+	displayName := fs.String("display-name", "token", "display name of the username template")
+	roleName := fs.String("role-name", "role", "role name of the username template")
+	password := fs.String("password", "", "password of the user, generated and masked when empty")
+	ttl := fs.Duration("ttl", time.Hour, "time to live of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	admin, err := newAdmin(ctx, *configPath, false)
+	if err != nil {
+		return err
+	}
+	defer admin.Close() //nolint:errcheck
+
+	maskedPassword := ""
+	if *password == "" {
+		if *password, err = base62.Random(20); err != nil {
+			return err
+		}
+		maskedPassword = *password
+	}
+	statements := dbplugin.Statements{Commands: fs.Args()}
+
+	var queries []string
+	switch *operation {
+	case "create":
+		var name string
+		name, queries, err = admin.RenderNewUser(dbplugin.NewUserRequest{
+			UsernameConfig: dbplugin.UsernameMetadata{DisplayName: *displayName, RoleName: *roleName},
+			Statements:     statements,
+			Password:       *password,
+			Expiration:     time.Now().Add(*ttl),
+		})
+		if err == nil {
+			_, err = fmt.Fprintf(stdout, "-- username: %s\n", name)
+		}
+	case "update":
+		queries, err = admin.RenderUpdateUser(dbplugin.UpdateUserRequest{
+			Username: *username,
+			Password: &dbplugin.ChangePassword{NewPassword: *password, Statements: statements},
+		})
+	case "delete":
+		queries, err = admin.RenderDeleteUser(dbplugin.DeleteUserRequest{Username: *username, Statements: statements})
+	default:
+		return fmt.Errorf("unknown operation %q", *operation)
+	}
+	if err != nil {
+		return err
+	}
+	for _, query := range queries {
+		if maskedPassword != "" {
+			query = strings.ReplaceAll(query, maskedPassword, "[password]")
+		}
+		if _, err = fmt.Fprintf(stdout, "%s;\n", query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createUser(ctx context.Context, fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	configPath := fs.String("config", "", "plugin configuration file")
+	displayName := fs.String("display-name", "cli", "display name of the username template")
+	roleName := fs.String("role-name", "cli", "role name of the username template")
+	password := fs.String("password", "", "password of the user, generated when empty")
+	ttl := fs.Duration("ttl", time.Hour, "time to live of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("creation statements are required")
+	}
+	admin, err := newAdmin(ctx, *configPath, true)
+	if err != nil {
+		return err
+	}
+	defer admin.Close() //nolint:errcheck
+
+	if *password == "" {
+		if *password, err = base62.Random(20); err != nil {
+			return err
+		}
+	}
+	resp, err := admin.NewUser(ctx, dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: *displayName, RoleName: *roleName},
+		Statements:     dbplugin.Statements{Commands: fs.Args()},
+		Password:       *password,
+		Expiration:     time.Now().Add(*ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(stdout, map[string]string{"username": resp.Username, "password": *password})
+}
+
+func revokeUser(ctx context.Context, fs *flag.FlagSet, args []string, _ io.Writer) error {
+	configPath := fs.String("config", "", "plugin configuration file")
+	username := fs.String("username", "", "name of the user to revoke")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("-username is required")
+	}
+	admin, err := newAdmin(ctx, *configPath, true)
+	if err != nil {
+		return err
+	}
+	defer admin.Close() //nolint:errcheck
+
+	_, err = admin.DeleteUser(ctx, dbplugin.DeleteUserRequest{
+		Username:   *username,
+		Statements: dbplugin.Statements{Commands: fs.Args()},
+	})
+
+	return err
+}
+
+func listManagedUsers(ctx context.Context, fs *flag.FlagSet, args []string, stdout io.Writer) error {
+	configPath := fs.String("config", "", "plugin configuration file")
+	prefix := fs.String("prefix", "v-", "prefix of the usernames generated by the username template")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	admin, err := newAdmin(ctx, *configPath, false)
+	if err != nil {
+		return err
+	}
+	defer admin.Close() //nolint:errcheck
+
+	users, err := admin.ListUsers(ctx, *prefix)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if _, err = fmt.Fprintln(stdout, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newAdmin initializes an Admin with the JSON configuration file at path
+func newAdmin(ctx context.Context, path string, verifyConnection bool) (*clickhouse.Admin, error) {
+	if path == "" {
+		return nil, errors.New("-config is required")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := map[string]interface{}{}
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	admin := clickhouse.NewAdmin()
+	if err = admin.Initialize(ctx, config, verifyConnection); err != nil {
+		return nil, err
+	}
+
+	return admin, nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// buildInfo returns the build metadata of the binary, with the version set
+// with -ldflags if any
+func buildInfo() clickhouse.BuildInfo {
+	info := clickhouse.ReadBuildInfo()
+	if version != "" {
+		info.Version = version
+	}
+
+	return info
+}
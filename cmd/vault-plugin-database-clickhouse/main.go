@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"os"
 
 	clickhouse "github.com/contentsquare/vault-plugin-database-clickhouse"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
 )
 
@@ -13,6 +17,23 @@ var (
 )
 
 func main() {
+	// Subcommands run from a shell, Vault runs the plugin without arguments
+	if len(os.Args) > 1 {
+		if os.Args[1] == "--version" || os.Args[1] == "-version" {
+			os.Args[1] = "version"
+		}
+		if _, ok := commands()[os.Args[1]]; ok {
+			if err := runCommand(context.Background(), os.Args[1], os.Args[2:], os.Stdout, os.Stderr); err != nil {
+				if !errors.Is(err, flag.ErrHelp) {
+					log.Println(err)
+				}
+				os.Exit(1)
+			}
+
+			return
+		}
+	}
+
 	err := Run()
 	if err != nil {
 		log.Println(err)
@@ -22,7 +43,28 @@ func main() {
 
 // Run instantiates a clickhouse object, and runs the RPC server for the plugin
 func Run() error {
-	f := clickhouse.New(clickhouse.DefaultUserNameTemplate, version)
+	// Vault parses the JSON logs written on stderr by its plugins, and
+	// filters them according to its own log level
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.Trace,
+		Output:     os.Stderr,
+		JSONFormat: true,
+	})
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background()) //nolint:gosec
+
+	shutdownMetrics, err := setupMetrics()
+	if err != nil {
+		return err
+	}
+	defer shutdownMetrics()
+
+	// Without -ldflags, New falls back to the version of the Go build info
+	f := clickhouse.New(clickhouse.DefaultUserNameTemplate, version, clickhouse.WithLogger(logger))
 
 	dbplugin.ServeMultiplex(f)
 
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// metricsURLEnv configures the sink of the metrics of the plugin
+const metricsURLEnv = "CLICKHOUSE_PLUGIN_METRICS_URL"
+
+// setupMetrics sends the metrics of the plugin to the sink of the URL in
+// metricsURLEnv, e.g. statsd://statsd:8125 or statsite://statsite:8125, set
+// with `vault plugin register -env`. Metrics are dropped when it is unset. It
+// returns a function flushing the pending metrics.
+func setupMetrics() (func(), error) {
+	sinkURL := os.Getenv(metricsURLEnv)
+	if sinkURL == "" {
+		return func() {}, nil
+	}
+
+	sink, err := metrics.NewMetricSinkFromURL(sinkURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", metricsURLEnv, err)
+	}
+	conf := metrics.DefaultConfig(serviceName)
+	// Keep the metric names the same on every host
+	conf.EnableHostname = false
+	if _, err = metrics.NewGlobal(conf, sink); err != nil {
+		return nil, err
+	}
+
+	return metrics.Shutdown, nil
+}
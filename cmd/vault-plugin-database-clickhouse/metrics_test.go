@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_setupMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close() //nolint:gosec
+
+	tests := []struct {
+		name     string
+		sinkURL  string
+		wantErr  string
+		wantSent bool
+	}{
+		{
+			name: "Should drop the metrics without sink",
+		},
+		{
+			name:    "Should reject an unknown sink",
+			sinkURL: "prometheus://localhost:9102",
+			wantErr: "invalid " + metricsURLEnv,
+		},
+		{
+			name:     "Should send the metrics to statsd",
+			sinkURL:  "statsd://" + conn.LocalAddr().String(),
+			wantSent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(metricsURLEnv, tt.sinkURL)
+
+			shutdown, err := setupMetrics()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+
+				return
+			}
+			require.NoError(t, err)
+			defer shutdown()
+			metrics.IncrCounter([]string{"clickhouse", "operation", "count"}, 1)
+
+			if tt.wantSent {
+				// The runtime metrics may come in other packets
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+				buf := make([]byte, 65536)
+				var lines []string
+				for !slices.Contains(lines, serviceName+".clickhouse.operation.count:1.000000|c") {
+					n, _, err := conn.ReadFrom(buf)
+					require.NoError(t, err)
+					lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+				}
+			}
+		})
+	}
+}
@@ -2,21 +2,31 @@ package vault_plugin_database_clickhouse
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/hashicorp/vault/sdk/database/helper/connutil"
 	"github.com/mitchellh/mapstructure"
 )
 
+const (
+	defaultHealthCheckInterval         = "30s"
+	defaultHealthCheckFailureThreshold = 3
+)
+
 // clickhouseConnectionProducer implements ConnectionProducer and provides a generic producer for most sql databases
 type clickhouseConnectionProducer struct {
 	ConnectionURL      string `json:"connection_url"          mapstructure:"connection_url"          structs:"connection_url"`
@@ -29,15 +39,70 @@ type clickhouseConnectionProducer struct {
 
 	TLS           bool `json:"tls" mapstructure:"tls" structs:"tls"`
 	TLSSkipVerify bool `json:"tls_skip_verify" mapstructure:"tls_skip_verify" structs:"tls_skip_verify"`
+	// PEM encoded CA verifying the server, and client certificate and key for
+	// mutual TLS. Setting any of them enables TLS.
+	TLSCA          string `json:"tls_ca" mapstructure:"tls_ca" structs:"tls_ca"`
+	TLSCertificate string `json:"tls_certificate" mapstructure:"tls_certificate" structs:"tls_certificate"`
+	TLSPrivateKey  string `json:"tls_private_key" mapstructure:"tls_private_key" structs:"tls_private_key"`
 
 	// https://github.com/ClickHouse/clickhouse-go#dsn
 	Database string `json:"database" mapstructure:"database" structs:"database"`
 	Debug    bool   `json:"debug" mapstructure:"debug" structs:"debug"`
 
-	RawConfig             map[string]interface{}
-	maxConnectionLifetime time.Duration
-	Initialized           bool
-	db                    *sql.DB
+	// Driver options, they take precedence over the ones of connection_url
+	MaxConnectionIdleTimeRaw interface{} `json:"max_connection_idle_time" mapstructure:"max_connection_idle_time" structs:"max_connection_idle_time"`
+	DialTimeoutRaw           interface{} `json:"dial_timeout" mapstructure:"dial_timeout" structs:"dial_timeout"`
+	ReadTimeoutRaw           interface{} `json:"read_timeout" mapstructure:"read_timeout" structs:"read_timeout"`
+	BlockBufferSize          int         `json:"block_buffer_size" mapstructure:"block_buffer_size" structs:"block_buffer_size"`
+
+	HealthCheckIntervalRaw      interface{} `json:"health_check_interval" mapstructure:"health_check_interval" structs:"health_check_interval"`
+	HealthCheckFailureThreshold int         `json:"health_check_failure_threshold" mapstructure:"health_check_failure_threshold" structs:"health_check_failure_threshold"`
+
+	RetryInitialIntervalRaw interface{} `json:"retry_initial_interval" mapstructure:"retry_initial_interval" structs:"retry_initial_interval"`
+	RetryMaxIntervalRaw     interface{} `json:"retry_max_interval" mapstructure:"retry_max_interval" structs:"retry_max_interval"`
+	RetryMaxElapsedTimeRaw  interface{} `json:"retry_max_elapsed_time" mapstructure:"retry_max_elapsed_time" structs:"retry_max_elapsed_time"`
+
+	StatementTimeoutRaw interface{} `json:"statement_timeout" mapstructure:"statement_timeout" structs:"statement_timeout"`
+	OperationTimeoutRaw interface{} `json:"operation_timeout" mapstructure:"operation_timeout" structs:"operation_timeout"`
+
+	// Cluster is the cluster ON CLUSTER statements run on, the admin needs the CLUSTER privilege
+	Cluster string `json:"cluster" mapstructure:"cluster" structs:"cluster"`
+	// GrantableRolesRaw are the roles creation statements grant, the admin must be able to grant them
+	GrantableRolesRaw interface{} `json:"grantable_roles" mapstructure:"grantable_roles" structs:"grantable_roles"`
+
+	// AccessStorage is the access storage, e.g. replicated, users are created in and dropped from
+	AccessStorage string `json:"access_storage" mapstructure:"access_storage" structs:"access_storage"`
+
+	// UserLimits enables the structured statements declaring the settings profile and quota of users, dropped
+	// along with them, the admin needs the privileges to create and drop both
+	UserLimits bool `json:"user_limits" mapstructure:"user_limits" structs:"user_limits"`
+
+	// PasswordComplexityRulesRaw mirrors the password_complexity rules of the server
+	PasswordComplexityRulesRaw interface{} `json:"password_complexity_rules" mapstructure:"password_complexity_rules" structs:"password_complexity_rules"`
+
+	RawConfig map[string]interface{}
+	// connectionString is the DSN rendered from connection_url and the
+	// other options, it embeds the password and must not leave the plugin
+	connectionString        string
+	tlsConfig               *tls.Config
+	addr                    string
+	database                string
+	maxConnectionLifetime   time.Duration
+	maxConnectionIdleTime   time.Duration
+	retryPolicy             retryPolicy
+	statementTimeout        time.Duration
+	operationTimeout        time.Duration
+	healthCheckInterval     time.Duration
+	lastHealthCheck         time.Time
+	healthCheckFailures     int
+	secrets                 map[string]string
+	passwordComplexityRules []passwordComplexityRule
+	grantableRoles          []string
+	// capabilities are nil until detected by a verified Init
+	capabilities *serverCapabilities
+	Initialized  bool
+	db           *sql.DB
+	logger       hclog.Logger
 	sync.Mutex
 }
 
@@ -51,6 +116,9 @@ func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string
 	c.Lock()
 	defer c.Unlock()
 	c.RawConfig = conf
+	if c.logger == nil {
+		c.logger = hclog.NewNullLogger()
+	}
 
 	err := mapstructure.WeakDecode(conf, &c)
 	if err != nil {
@@ -78,10 +146,22 @@ func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string
 	if c.Password != "" {
 		connBuilder.WithPassword(c.Password)
 	}
-	c.ConnectionURL, err = connBuilder.BuildConnectionString()
+	if err = c.applyDriverOptions(connBuilder); err != nil {
+		return nil, err
+	}
+	if c.tlsConfig, err = buildTLSConfig(c.TLSCA, c.TLSCertificate, c.TLSPrivateKey, connBuilder.tlsSkipVerify); err != nil {
+		return nil, err
+	}
+	if c.tlsConfig != nil && !connBuilder.tls {
+		connBuilder.WithTLS(connBuilder.tlsSkipVerify)
+	}
+	c.addr = net.JoinHostPort(connBuilder.host, strconv.Itoa(connBuilder.port))
+	c.database = connBuilder.database
+	c.connectionString, err = connBuilder.BuildConnectionString()
 	if err != nil {
 		return nil, err
 	}
+	c.secrets = secretValues(connBuilder, c.connectionString)
 
 	if c.MaxOpenConnections == 0 {
 		c.MaxOpenConnections = 4
@@ -102,6 +182,54 @@ func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string
 		return nil, fmt.Errorf("invalid max_connection_lifetime: %w", err)
 	}
 
+	if c.maxConnectionIdleTime, err = parseDuration("max_connection_idle_time", c.MaxConnectionIdleTimeRaw, "0s"); err != nil {
+		return nil, err
+	}
+
+	if c.healthCheckInterval, err = parseDuration("health_check_interval", c.HealthCheckIntervalRaw, defaultHealthCheckInterval); err != nil {
+		return nil, err
+	}
+	if c.HealthCheckFailureThreshold < 0 {
+		return nil, errors.New("health_check_failure_threshold cannot be negative")
+	}
+	if c.HealthCheckFailureThreshold == 0 {
+		c.HealthCheckFailureThreshold = defaultHealthCheckFailureThreshold
+	}
+
+	if c.retryPolicy.initialInterval, err = parseDuration("retry_initial_interval", c.RetryInitialIntervalRaw, defaultRetryInitialInterval); err != nil {
+		return nil, err
+	}
+	if c.retryPolicy.maxInterval, err = parseDuration("retry_max_interval", c.RetryMaxIntervalRaw, defaultRetryMaxInterval); err != nil {
+		return nil, err
+	}
+	if c.retryPolicy.maxElapsedTime, err = parseDuration("retry_max_elapsed_time", c.RetryMaxElapsedTimeRaw, defaultRetryMaxElapsedTime); err != nil {
+		return nil, err
+	}
+	if c.retryPolicy.initialInterval > c.retryPolicy.maxInterval {
+		return nil, errors.New("retry_initial_interval cannot be greater than retry_max_interval")
+	}
+
+	if c.statementTimeout, err = parseDuration("statement_timeout", c.StatementTimeoutRaw, "0s"); err != nil {
+		return nil, err
+	}
+	if c.operationTimeout, err = parseDuration("operation_timeout", c.OperationTimeoutRaw, "0s"); err != nil {
+		return nil, err
+	}
+
+	if c.grantableRoles, err = parseutil.ParseCommaStringSlice(c.GrantableRolesRaw); err != nil {
+		return nil, fmt.Errorf("invalid grantable_roles: %w", err)
+	}
+
+	if c.AccessStorage != "" {
+		if err = validateAccessStorage(c.AccessStorage, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.passwordComplexityRules, err = parsePasswordComplexityRules(c.PasswordComplexityRulesRaw); err != nil {
+		return nil, err
+	}
+
 	// Set initialized to true at this point since all fields are set,
 	// and the connection can be established at a later time.
 	c.Initialized = true
@@ -114,28 +242,103 @@ func (c *clickhouseConnectionProducer) Init(ctx context.Context, conf map[string
 		if err = c.db.PingContext(ctx); err != nil {
 			return nil, fmt.Errorf("error verifying - ping: %w", err)
 		}
+
+		if c.capabilities, err = detectCapabilities(ctx, c.db); err != nil {
+			return nil, fmt.Errorf("error verifying - capabilities: %w", err)
+		}
+		c.logger.Info("detected server", "host", c.addr, "version", c.capabilities.version.String(),
+			"access_storages", c.capabilities.accessStorages)
+
+		if c.AccessStorage != "" {
+			if err = validateAccessStorage(c.AccessStorage, c.capabilities); err != nil {
+				return nil, fmt.Errorf("error verifying - %w", err)
+			}
+		}
+
+		if err = checkPrivileges(ctx, c.db, c.logger, c.Cluster, c.grantableRoles, c.UserLimits); err != nil {
+			return nil, fmt.Errorf("error verifying - privileges: %w", err)
+		}
+	} else {
+		c.capabilities = nil
 	}
 
 	return c.RawConfig, nil
 }
 
+// applyDriverOptions validates the driver timeouts and buffer size and sets
+// them on the connection string
+func (c *clickhouseConnectionProducer) applyDriverOptions(connBuilder *connStringBuilder) error {
+	if c.DialTimeoutRaw != nil {
+		dialTimeout, err := parseDuration("dial_timeout", c.DialTimeoutRaw, "0s")
+		if err != nil {
+			return err
+		}
+		connBuilder.WithDialTimeout(dialTimeout)
+	}
+	if c.ReadTimeoutRaw != nil {
+		readTimeout, err := parseDuration("read_timeout", c.ReadTimeoutRaw, "0s")
+		if err != nil {
+			return err
+		}
+		connBuilder.WithReadTimeout(readTimeout)
+	}
+	if c.BlockBufferSize < 0 || c.BlockBufferSize > math.MaxUint8 {
+		return fmt.Errorf("invalid block_buffer_size: must be between 1 and %d", math.MaxUint8)
+	}
+	if c.BlockBufferSize != 0 {
+		connBuilder.WithBlockBufferSize(uint8(c.BlockBufferSize))
+	}
+
+	return nil
+}
+
+// parseDuration parses the duration config field name, using def when it is
+// not set. Negative durations are rejected.
+func parseDuration(name string, raw interface{}, def string) (time.Duration, error) {
+	if raw == nil {
+		raw = def
+	}
+	d, err := parseutil.ParseDurationSecond(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s: cannot be negative", name)
+	}
+
+	return d, nil
+}
+
 func (c *clickhouseConnectionProducer) Connection(ctx context.Context) (interface{}, error) {
+	start := time.Now()
+	db, err := c.connection(ctx)
+	emitConnectionMetrics(start, err)
+	if err != nil {
+		return nil, err
+	}
+	emitPoolMetrics(db.Stats())
+
+	return db, nil
+}
+
+func (c *clickhouseConnectionProducer) connection(ctx context.Context) (*sql.DB, error) {
 	if !c.Initialized {
 		return nil, connutil.ErrNotInitialized
 	}
 
-	// If we already have a DB, test it and return
+	// If we already have a healthy DB, return it
 	if c.db != nil {
-		if err := c.db.PingContext(ctx); err == nil {
+		if c.checkHealth(ctx) {
 			return c.db, nil
 		}
-		// If the ping was unsuccessful, close it and ignore errors as we'll be
-		// reestablishing anyways
+		// The pool failed too many health checks in a row, close it and ignore
+		// errors as we'll be reestablishing anyways
+		c.logger.Warn("rebuilding connection pool", "host", c.addr, "failed_health_checks", c.healthCheckFailures)
 		c.db.Close() //nolint:gosec
 	}
+	c.logger.Debug("opening connection pool", "host", c.addr)
 	var err error
-	c.db, err = sql.Open("clickhouse", c.ConnectionURL)
-	if err != nil {
+	if c.db, err = c.openDB(); err != nil {
 		return nil, err
 	}
 
@@ -144,14 +347,162 @@ func (c *clickhouseConnectionProducer) Connection(ctx context.Context) (interfac
 	c.db.SetMaxOpenConns(c.MaxOpenConnections)
 	c.db.SetMaxIdleConns(c.MaxIdleConnections)
 	c.db.SetConnMaxLifetime(c.maxConnectionLifetime)
+	c.db.SetConnMaxIdleTime(c.maxConnectionIdleTime)
+
+	// database/sql dials lazily, a new pool is deemed healthy until it's used
+	c.lastHealthCheck = time.Now()
+	c.healthCheckFailures = 0
 
 	return c.db, nil
 }
 
+// openDB opens a pool on the connection string, secured with the TLS
+// configuration of the tls_* options if any
+func (c *clickhouseConnectionProducer) openDB() (*sql.DB, error) {
+	if c.tlsConfig == nil {
+		return sql.Open("clickhouse", c.connectionString)
+	}
+	options, err := clickhouse.ParseDSN(c.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	options.TLS = c.tlsConfig
+
+	return clickhouse.OpenDB(options), nil
+}
+
+// checkHealth reports whether the current pool can be kept. database/sql
+// already discards broken connections on its own, so the pool is pinged at
+// most once per health check interval, and again on the next call after a
+// failure. It is only deemed unhealthy, and rebuilt, after
+// health_check_failure_threshold consecutive failed pings.
+func (c *clickhouseConnectionProducer) checkHealth(ctx context.Context) bool {
+	if c.healthCheckFailures == 0 && time.Since(c.lastHealthCheck) < c.healthCheckInterval {
+		return true
+	}
+
+	c.lastHealthCheck = time.Now()
+	if err := c.db.PingContext(ctx); err != nil {
+		c.healthCheckFailures++
+		c.logger.Warn("health check failed", "host", c.addr, "failures", c.healthCheckFailures, "error", c.sanitize(err, nil))
+
+		return c.healthCheckFailures < c.HealthCheckFailureThreshold
+	}
+	c.healthCheckFailures = 0
+
+	return true
+}
+
+// statementSettings returns the ClickHouse settings enforcing the statement
+// timeout server side, rounded up to the second.
+func (c *clickhouseConnectionProducer) statementSettings() clickhouse.Settings {
+	if c.statementTimeout <= 0 {
+		return nil
+	}
+	seconds := int((c.statementTimeout + time.Second - 1) / time.Second)
+
+	return clickhouse.Settings{
+		"max_execution_time":           seconds,
+		"distributed_ddl_task_timeout": seconds,
+	}
+}
+
+// SecretValues returns the secrets to mask in errors: the password, raw and
+// URL-encoded, the TLS private key, secret query parameters of
+// connection_url, and the rendered connection string itself.
 func (c *clickhouseConnectionProducer) SecretValues() map[string]string {
-	return map[string]string{
-		c.Password: "[password]",
+	secrets := map[string]string{}
+	addSecret(secrets, c.Password, "[password]")
+	if c.TLSPrivateKey != "" {
+		secrets[c.TLSPrivateKey] = "[tls_private_key]"
+	}
+	maps.Copy(secrets, c.secrets)
+
+	return secrets
+}
+
+// secretValues returns the secrets of the connection string built by b, dsn
+func secretValues(b *connStringBuilder, dsn string) map[string]string {
+	secrets := map[string]string{}
+	addSecret(secrets, b.password, "[password]")
+	for k, v := range b.extra {
+		if isSecretParam(k) {
+			addSecret(secrets, v, "["+k+"]")
+		}
+	}
+	if dsn != "" {
+		secrets[dsn] = "[connection_url]"
+	}
+
+	return secrets
+}
+
+// addSecret masks value with replacement, in the forms it takes in a URL too
+func addSecret(secrets map[string]string, value string, replacement string) {
+	if value == "" {
+		return
 	}
+	secrets[value] = replacement
+	secrets[url.QueryEscape(value)] = replacement
+	secrets[url.PathEscape(value)] = replacement
+}
+
+// isSecretParam reports whether the query parameter key looks like it holds a secret
+func isSecretParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "secret", "token", "key"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitize returns the message of err with the secret values of the
+// producer, and the password of queryMap if any, masked. It is meant for logs
+// and traces.
+func (c *clickhouseConnectionProducer) sanitize(err error, queryMap map[string]string) string {
+	if err == nil {
+		return ""
+	}
+	// As the sanitizer middleware, don't echo a connection URL that failed to parse
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "unable to parse connection url"
+	}
+
+	return c.maskSecrets(err.Error(), queryMap)
+}
+
+// sanitizeError returns err with the secrets masked as by sanitize, in its
+// message and in the errors it wraps, so that errors.Is and errors.As still
+// work on it without leaking them.
+func (c *clickhouseConnectionProducer) sanitizeError(err error, queryMap map[string]string) error {
+	if err == nil {
+		return nil
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return errors.New("unable to parse connection url")
+	}
+
+	return maskError(err, func(msg string) string {
+		return c.maskSecrets(msg, queryMap)
+	})
+}
+
+// maskSecrets masks the secret values of the producer, and the password of
+// queryMap if any, in msg
+func (c *clickhouseConnectionProducer) maskSecrets(msg string, queryMap map[string]string) string {
+	for find, replace := range c.SecretValues() {
+		msg = strings.ReplaceAll(msg, find, replace)
+	}
+	if password := queryMap["password"]; password != "" {
+		msg = strings.ReplaceAll(msg, password, "[password]")
+	}
+
+	return msg
 }
 
 // Close attempts to close the connection
@@ -161,6 +512,7 @@ func (c *clickhouseConnectionProducer) Close() error {
 	defer c.Unlock()
 
 	if c.db != nil {
+		c.logger.Debug("closing connection pool", "host", c.addr)
 		c.db.Close() //nolint:gosec
 	}
 
@@ -178,7 +530,11 @@ type connStringBuilder struct {
 	tlsSkipVerify bool
 	username      string
 	password      string
-	extra         map[string]string
+	// zero values leave the driver defaults
+	dialTimeout     time.Duration
+	readTimeout     time.Duration
+	blockBufferSize uint8
+	extra           map[string]string
 }
 
 func (c *connStringBuilder) WithHost(host string) *connStringBuilder {
@@ -224,13 +580,31 @@ func (c *connStringBuilder) WithPassword(password string) *connStringBuilder {
 	return c
 }
 
+func (c *connStringBuilder) WithDialTimeout(timeout time.Duration) *connStringBuilder {
+	c.dialTimeout = timeout
+
+	return c
+}
+
+func (c *connStringBuilder) WithReadTimeout(timeout time.Duration) *connStringBuilder {
+	c.readTimeout = timeout
+
+	return c
+}
+
+func (c *connStringBuilder) WithBlockBufferSize(size uint8) *connStringBuilder {
+	c.blockBufferSize = size
+
+	return c
+}
+
 func NewConnStringBuilderFromConnString(connString string) (*connStringBuilder, error) {
 	c := &connStringBuilder{
 		extra: map[string]string{},
 	}
 	parsed, err := url.Parse(connString)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing url. err=%v", err.Error())
+		return nil, fmt.Errorf("error parsing url. err=%w", err)
 	}
 	split := strings.Split(parsed.Host, ":")
 	c.host = split[0]
@@ -262,6 +636,24 @@ func NewConnStringBuilderFromConnString(connString string) (*connStringBuilder,
 				return nil, err
 			}
 			c.tlsSkipVerify = skipVerify
+		case "dial_timeout":
+			dialTimeout, err := time.ParseDuration(v[0])
+			if err != nil {
+				return nil, err
+			}
+			c.dialTimeout = dialTimeout
+		case "read_timeout":
+			readTimeout, err := time.ParseDuration(v[0])
+			if err != nil {
+				return nil, err
+			}
+			c.readTimeout = readTimeout
+		case "block_buffer_size":
+			blockBufferSize, err := strconv.ParseUint(v[0], 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			c.blockBufferSize = uint8(blockBufferSize)
 		default:
 			c.extra[k] = v[0]
 		}
@@ -294,6 +686,15 @@ func (c *connStringBuilder) BuildConnectionString() (string, error) {
 	if c.debug {
 		q.Set("debug", "true")
 	}
+	if c.dialTimeout > 0 {
+		q.Set("dial_timeout", c.dialTimeout.String())
+	}
+	if c.readTimeout > 0 {
+		q.Set("read_timeout", c.readTimeout.String())
+	}
+	if c.blockBufferSize > 0 {
+		q.Set("block_buffer_size", strconv.Itoa(int(c.blockBufferSize)))
+	}
 	for k, v := range c.extra {
 		q.Set(k, v)
 	}
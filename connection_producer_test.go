@@ -1,23 +1,34 @@
 package vault_plugin_database_clickhouse
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	clickhousehelper "github.com/contentsquare/vault-plugin-database-clickhouse/testhelpers/clickhouse"
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_connStringBuilder_buildConnectionString(t *testing.T) {
 	type fields struct {
-		host          string
-		port          int
-		database      string
-		debug         bool
-		tls           bool
-		tlsSkipVerify bool
-		username      string
-		password      string
-		extra         map[string]string
+		host            string
+		port            int
+		database        string
+		debug           bool
+		tls             bool
+		tlsSkipVerify   bool
+		username        string
+		password        string
+		dialTimeout     time.Duration
+		readTimeout     time.Duration
+		blockBufferSize uint8
+		extra           map[string]string
 	}
 	tests := []struct {
 		name    string
@@ -103,19 +114,36 @@ func Test_connStringBuilder_buildConnectionString(t *testing.T) {
 			want:    "tcp://someHost:1234/someDatabase?other_param=bladibla&password=bladibla&secure=true&skip_verify=true&someparam=somevalue&username=bob",
 			wantErr: false,
 		},
+		{
+			name: "Should add the driver timeouts and block buffer size to the DSN",
+			fields: fields{
+				host:            "someHost",
+				port:            1234,
+				username:        "bob",
+				password:        "bladibla",
+				dialTimeout:     5 * time.Second,
+				readTimeout:     time.Minute,
+				blockBufferSize: 10,
+			},
+			want:    "tcp://someHost:1234?block_buffer_size=10&dial_timeout=5s&password=bladibla&read_timeout=1m0s&username=bob",
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := &connStringBuilder{
-				host:          tt.fields.host,
-				port:          tt.fields.port,
-				database:      tt.fields.database,
-				debug:         tt.fields.debug,
-				tls:           tt.fields.tls,
-				tlsSkipVerify: tt.fields.tlsSkipVerify,
-				username:      tt.fields.username,
-				password:      tt.fields.password,
-				extra:         tt.fields.extra,
+				host:            tt.fields.host,
+				port:            tt.fields.port,
+				database:        tt.fields.database,
+				debug:           tt.fields.debug,
+				tls:             tt.fields.tls,
+				tlsSkipVerify:   tt.fields.tlsSkipVerify,
+				username:        tt.fields.username,
+				password:        tt.fields.password,
+				dialTimeout:     tt.fields.dialTimeout,
+				readTimeout:     tt.fields.readTimeout,
+				blockBufferSize: tt.fields.blockBufferSize,
+				extra:           tt.fields.extra,
 			}
 			got, err := c.BuildConnectionString()
 			if (err != nil) != tt.wantErr {
@@ -247,6 +275,38 @@ func TestNewConnStringBuilderFromConnString(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Should return a Builder with driver timeouts and block buffer size",
+			args: args{
+				connString: "tcp://someHost:1234/someDB?dial_timeout=5s&read_timeout=1m&block_buffer_size=10",
+			},
+			want: &connStringBuilder{
+				host:            "someHost",
+				port:            1234,
+				database:        "someDB",
+				dialTimeout:     5 * time.Second,
+				readTimeout:     time.Minute,
+				blockBufferSize: 10,
+				extra:           map[string]string{},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Should return an error on failed parse dial_timeout",
+			args: args{
+				connString: "tcp://someHost:1234/someDB?dial_timeout=bladibla",
+			},
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name: "Should return an error on out of range block_buffer_size",
+			args: args{
+				connString: "tcp://someHost:1234/someDB?block_buffer_size=256",
+			},
+			want:    nil,
+			wantErr: true,
+		},
 		{
 			name: "Should return an error on failed parsebool tls",
 			args: args{
@@ -586,3 +646,319 @@ func Test_connStringBuilder_WithDebug(t *testing.T) {
 		})
 	}
 }
+
+func Test_clickhouseConnectionProducer_statementSettings(t *testing.T) {
+	tests := []struct {
+		name             string
+		statementTimeout time.Duration
+		want             clickhouse.Settings
+	}{
+		{
+			name:             "Should not set anything without a statement timeout",
+			statementTimeout: 0,
+			want:             nil,
+		},
+		{
+			name:             "Should set the timeout in seconds",
+			statementTimeout: 30 * time.Second,
+			want:             clickhouse.Settings{"max_execution_time": 30, "distributed_ddl_task_timeout": 30},
+		},
+		{
+			name:             "Should round the timeout up to the second",
+			statementTimeout: 1500 * time.Millisecond,
+			want:             clickhouse.Settings{"max_execution_time": 2, "distributed_ddl_task_timeout": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clickhouseConnectionProducer{statementTimeout: tt.statementTimeout}
+			if got := c.statementSettings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statementSettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clickhouseConnectionProducer_Init(t *testing.T) {
+	tests := []struct {
+		name                 string
+		conf                 map[string]interface{}
+		wantStatementTimeout time.Duration
+		wantOperationTimeout time.Duration
+		wantErr              bool
+	}{
+		{
+			name: "Should not set timeouts by default",
+			conf: map[string]interface{}{
+				"connection_url": "tcp://someHost:9000",
+			},
+		},
+		{
+			name: "Should parse timeouts",
+			conf: map[string]interface{}{
+				"connection_url":    "tcp://someHost:9000",
+				"statement_timeout": "30s",
+				"operation_timeout": 120,
+			},
+			wantStatementTimeout: 30 * time.Second,
+			wantOperationTimeout: 2 * time.Minute,
+		},
+		{
+			name: "Should reject an invalid statement_timeout",
+			conf: map[string]interface{}{
+				"connection_url":    "tcp://someHost:9000",
+				"statement_timeout": "bladibla",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Should reject a negative operation_timeout",
+			conf: map[string]interface{}{
+				"connection_url":    "tcp://someHost:9000",
+				"operation_timeout": "-1s",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clickhouseConnectionProducer{}
+			_, err := c.Init(t.Context(), tt.conf, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if c.statementTimeout != tt.wantStatementTimeout {
+				t.Errorf("Init() statementTimeout = %v, want %v", c.statementTimeout, tt.wantStatementTimeout)
+			}
+			if c.operationTimeout != tt.wantOperationTimeout {
+				t.Errorf("Init() operationTimeout = %v, want %v", c.operationTimeout, tt.wantOperationTimeout)
+			}
+		})
+	}
+}
+
+func Test_clickhouseConnectionProducer_Init_driverOptions(t *testing.T) {
+	tests := []struct {
+		name                      string
+		conf                      map[string]interface{}
+		wantConnectionString      string
+		wantMaxConnectionIdleTime time.Duration
+		wantErr                   bool
+	}{
+		{
+			name: "Should keep the driver defaults",
+			conf: map[string]interface{}{
+				"connection_url": "tcp://someHost:9000",
+			},
+			wantConnectionString: "tcp://someHost:9000",
+		},
+		{
+			name: "Should override the connection_url options",
+			conf: map[string]interface{}{
+				"connection_url":           "tcp://someHost:9000?dial_timeout=1s",
+				"max_connection_idle_time": "5m",
+				"dial_timeout":             10,
+				"read_timeout":             "1m",
+				"block_buffer_size":        "4",
+			},
+			wantConnectionString:      "tcp://someHost:9000?block_buffer_size=4&dial_timeout=10s&read_timeout=1m0s",
+			wantMaxConnectionIdleTime: 5 * time.Minute,
+		},
+		{
+			name: "Should reject a negative dial_timeout",
+			conf: map[string]interface{}{
+				"connection_url": "tcp://someHost:9000",
+				"dial_timeout":   "-1s",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Should reject an invalid max_connection_idle_time",
+			conf: map[string]interface{}{
+				"connection_url":           "tcp://someHost:9000",
+				"max_connection_idle_time": "bladibla",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Should reject an out of range block_buffer_size",
+			conf: map[string]interface{}{
+				"connection_url":    "tcp://someHost:9000",
+				"block_buffer_size": 256,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clickhouseConnectionProducer{}
+			_, err := c.Init(t.Context(), tt.conf, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if c.connectionString != tt.wantConnectionString {
+				t.Errorf("Init() connectionString = %v, want %v", c.connectionString, tt.wantConnectionString)
+			}
+			if c.maxConnectionIdleTime != tt.wantMaxConnectionIdleTime {
+				t.Errorf("Init() maxConnectionIdleTime = %v, want %v", c.maxConnectionIdleTime, tt.wantMaxConnectionIdleTime)
+			}
+		})
+	}
+}
+
+func Test_clickhouseConnectionProducer_Connection_healthCheck(t *testing.T) {
+	c := &clickhouseConnectionProducer{}
+	// Nothing listens on port 1, every ping fails right away
+	_, err := c.Init(t.Context(), map[string]interface{}{
+		"connection_url":                 "tcp://127.0.0.1:1?dial_timeout=100ms",
+		"health_check_interval":          "1h",
+		"health_check_failure_threshold": 2,
+		"retry_max_elapsed_time":         0,
+	}, false)
+	if err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	defer c.Close()
+
+	first, err := c.Connection(t.Context())
+	require.NoError(t, err)
+
+	got, err := c.Connection(t.Context())
+	require.NoError(t, err)
+	require.Same(t, first, got, "pool should be reused without pinging within the health check interval")
+	require.Equal(t, 0, c.healthCheckFailures)
+
+	// Expire the health check interval
+	c.lastHealthCheck = time.Now().Add(-2 * time.Hour)
+	got, err = c.Connection(t.Context())
+	require.NoError(t, err)
+	require.Same(t, first, got, "pool should be kept after a single failed ping")
+	require.Equal(t, 1, c.healthCheckFailures)
+
+	got, err = c.Connection(t.Context())
+	require.NoError(t, err)
+	require.NotSame(t, first, got, "pool should be rebuilt after repeated failed pings")
+	require.Equal(t, 0, c.healthCheckFailures)
+}
+
+// erroringDatabase fails every Initialize call with err
+type erroringDatabase struct {
+	dbplugin.Database
+
+	err error
+}
+
+func (d erroringDatabase) Initialize(context.Context, dbplugin.InitializeRequest) (dbplugin.InitializeResponse, error) {
+	return dbplugin.InitializeResponse{}, d.err
+}
+
+func Test_clickhouseConnectionProducer_SecretValues(t *testing.T) {
+	const password = "p@ss w/rd&1"
+	material, err := clickhousehelper.GenerateTLSMaterial(t.TempDir())
+	require.NoError(t, err)
+	c := &clickhouseConnectionProducer{}
+	_, err = c.Init(t.Context(), map[string]interface{}{
+		"connection_url":  "tcp://someHost:9000?access_token=s3cr3t-t0k3n&compress=lz4",
+		"username":        "admin",
+		"password":        password,
+		"tls_certificate": string(material.ClientCertificate),
+		"tls_private_key": string(material.ClientPrivateKey),
+	}, false)
+	require.NoError(t, err)
+
+	secrets := []string{
+		password,
+		url.QueryEscape(password),
+		url.PathEscape(password),
+		"s3cr3t-t0k3n",
+		c.connectionString,
+		string(material.ClientPrivateKey),
+	}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{
+			name: "Should mask the raw password",
+			err:  fmt.Errorf("code: 516, message: admin: Authentication failed: password %s is incorrect", password),
+		},
+		{
+			name: "Should mask the query escaped password",
+			err:  fmt.Errorf("invalid dsn param password=%s", url.QueryEscape(password)),
+		},
+		{
+			name: "Should mask the path escaped password",
+			err:  fmt.Errorf("invalid dsn path %s", url.PathEscape(password)),
+		},
+		{
+			name: "Should mask secret query parameters",
+			err:  errors.New("unknown setting access_token=s3cr3t-t0k3n"),
+		},
+		{
+			name: "Should mask the rendered connection string",
+			err:  fmt.Errorf("unable to open %s", c.connectionString),
+		},
+		{
+			name: "Should mask the TLS private key",
+			err:  fmt.Errorf("tls: failed to parse private key %s", material.ClientPrivateKey),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbplugin.NewDatabaseErrorSanitizerMiddleware(erroringDatabase{err: tt.err}, c.SecretValues)
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{})
+			require.Error(t, err)
+			for _, secret := range secrets {
+				require.NotContains(t, err.Error(), secret)
+				require.NotContains(t, c.sanitize(tt.err, nil), secret)
+				require.NotContains(t, c.sanitizeError(tt.err, nil).Error(), secret)
+			}
+		})
+	}
+}
+
+func TestClickhouse_Initialize_sanitizesDriverErrors(t *testing.T) {
+	const password = "p@ss w/rd&1"
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{
+			name: "Should not leak a password of a connection_url that fails to parse",
+			config: map[string]interface{}{
+				"connection_url": "tcp://someHost:9000/%zz?password=" + url.QueryEscape(password),
+			},
+		},
+		{
+			name: "Should not leak the password when the connection fails",
+			config: map[string]interface{}{
+				"connection_url":         "tcp://127.0.0.1:1",
+				"password":               password,
+				"dial_timeout":           "100ms",
+				"retry_max_elapsed_time": "0s",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := New(DefaultUserNameTemplate, "v0.0.0-test")()
+			require.NoError(t, err)
+			plugin := db.(dbplugin.Database)
+			defer plugin.Close()
+
+			_, err = plugin.Initialize(t.Context(), dbplugin.InitializeRequest{
+				Config:           tt.config,
+				VerifyConnection: true,
+			})
+			require.Error(t, err)
+			require.NotContains(t, err.Error(), password)
+			require.NotContains(t, err.Error(), url.QueryEscape(password))
+		})
+	}
+}
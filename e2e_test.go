@@ -0,0 +1,121 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"testing"
+
+	clickhousehelper "github.com/contentsquare/vault-plugin-database-clickhouse/testhelpers/clickhouse"
+	vaulthelper "github.com/contentsquare/vault-plugin-database-clickhouse/testhelpers/vault"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVault_e2e runs the plugin binary under a Vault dev server, and
+// exercises the database secrets engine through the Vault API
+func TestVault_e2e(t *testing.T) {
+	vault := vaulthelper.StartDevServer(t)
+	vault.RegisterPlugin(t, "./cmd/vault-plugin-database-clickhouse", "vault-plugin-database-clickhouse")
+
+	cleanup, connURL := clickhousehelper.PrepareTestContainer(t, false, "admin_user", "secret")
+	defer cleanup()
+
+	// The admin of users.xml is read-only, Vault gets an admin it can rotate
+	admin, err := sql.Open("clickhouse", connURL)
+	require.NoError(t, err)
+	defer admin.Close()
+	for _, query := range []string{
+		"CREATE USER vault_admin IDENTIFIED BY 'vault_secret'",
+		"GRANT ALL ON *.* TO vault_admin WITH GRANT OPTION",
+		"CREATE USER static_user IDENTIFIED BY 'static_secret'",
+	} {
+		_, err = admin.ExecContext(t.Context(), query)
+		require.NoError(t, err)
+	}
+	parsed, err := url.Parse(connURL)
+	require.NoError(t, err)
+	parsed.RawQuery = ""
+
+	userURL := func(username, password string) string {
+		q := make(url.Values)
+		q.Set("username", username)
+		q.Set("password", password)
+		u := *parsed
+		u.RawQuery = q.Encode()
+
+		return u.String()
+	}
+	request := func(method, path string, body map[string]interface{}) *vaulthelper.Response {
+		t.Helper()
+		resp, err := vault.Request(t.Context(), method, path, body)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	request(http.MethodPost, "sys/mounts/database", map[string]interface{}{"type": "database"})
+	request(http.MethodPost, "database/config/clickhouse", map[string]interface{}{
+		"plugin_name":    "vault-plugin-database-clickhouse",
+		"connection_url": parsed.String(),
+		"username":       "vault_admin",
+		"password":       "vault_secret",
+		"allowed_roles":  "*",
+	})
+
+	t.Run("Should issue, renew and revoke dynamic credentials", func(t *testing.T) {
+		request(http.MethodPost, "database/roles/dynamic", map[string]interface{}{
+			"db_name":             "clickhouse",
+			"creation_statements": []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT SELECT ON *.* TO '{{name}}';"},
+			"default_ttl":         "1m",
+			"max_ttl":             "10m",
+		})
+
+		creds := request(http.MethodGet, "database/creds/dynamic", nil)
+		username, _ := creds.Data["username"].(string)
+		password, _ := creds.Data["password"].(string)
+		require.NotEmpty(t, username)
+		require.NoError(t, clickhousehelper.TestCredsExist(t, userURL(username, password)))
+
+		renewed := request(http.MethodPut, "sys/leases/renew", map[string]interface{}{
+			"lease_id":  creds.LeaseID,
+			"increment": "5m",
+		})
+		require.Equal(t, creds.LeaseID, renewed.LeaseID)
+		require.Greater(t, renewed.LeaseDuration, creds.LeaseDuration)
+		require.NoError(t, clickhousehelper.TestCredsExist(t, userURL(username, password)))
+
+		request(http.MethodPut, "sys/leases/revoke", map[string]interface{}{"lease_id": creds.LeaseID, "sync": true})
+		require.Error(t, clickhousehelper.TestCredsExist(t, userURL(username, password)))
+	})
+
+	t.Run("Should manage and rotate static credentials", func(t *testing.T) {
+		request(http.MethodPost, "database/static-roles/static", map[string]interface{}{
+			"db_name":         "clickhouse",
+			"username":        "static_user",
+			"rotation_period": "1h",
+		})
+		creds := request(http.MethodGet, "database/static-creds/static", nil)
+		password, _ := creds.Data["password"].(string)
+		require.NotEqual(t, "static_secret", password)
+		require.Error(t, clickhousehelper.TestCredsExist(t, userURL("static_user", "static_secret")))
+		require.NoError(t, clickhousehelper.TestCredsExist(t, userURL("static_user", password)))
+
+		request(http.MethodPost, "database/rotate-role/static", nil)
+		rotated := request(http.MethodGet, "database/static-creds/static", nil)
+		rotatedPassword, _ := rotated.Data["password"].(string)
+		require.NotEqual(t, password, rotatedPassword)
+		require.Error(t, clickhousehelper.TestCredsExist(t, userURL("static_user", password)))
+		require.NoError(t, clickhousehelper.TestCredsExist(t, userURL("static_user", rotatedPassword)))
+	})
+
+	t.Run("Should rotate the root credentials", func(t *testing.T) {
+		request(http.MethodPost, "database/rotate-root/clickhouse", nil)
+		require.Error(t, clickhousehelper.TestCredsExist(t, userURL("vault_admin", "vault_secret")))
+
+		// The plugin reconnects with the rotated password
+		creds := request(http.MethodGet, "database/creds/dynamic", nil)
+		username, _ := creds.Data["username"].(string)
+		password, _ := creds.Data["password"].(string)
+		require.NoError(t, clickhousehelper.TestCredsExist(t, userURL(username, password)))
+	})
+}
@@ -0,0 +1,185 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const (
+	operationInitialize = "Initialize"
+	operationNewUser    = "NewUser"
+	operationDeleteUser = "DeleteUser"
+	operationUpdateUser = "UpdateUser"
+)
+
+// ClickHouse server exception codes the plugin reacts to.
+// See https://github.com/ClickHouse/ClickHouse/blob/master/src/Common/ErrorCodes.cpp
+const (
+	codeTimeoutExceeded            int32 = 159
+	codeUnknownUser                int32 = 192
+	codeTooManySimultaneousQueries int32 = 202
+	codeNoFreeConnection           int32 = 203
+	codeSocketTimeout              int32 = 209
+	codeNetworkError               int32 = 210
+	codeNoZooKeeper                int32 = 225
+	codeTableIsReadOnly            int32 = 242
+	codeAllConnectionTriesFailed   int32 = 279
+	codeAccessEntityNotFound       int32 = 492
+	codeAccessEntityAlreadyExists  int32 = 493
+	codeAccessDenied               int32 = 497
+	codeUnknownRole                int32 = 511
+	codeAuthenticationFailed       int32 = 516
+	codeKeeperException            int32 = 999
+)
+
+var (
+	// ErrAccessEntityAlreadyExists is matched when ClickHouse refuses to create an access entity that already exists
+	ErrAccessEntityAlreadyExists = errors.New("access entity already exists")
+	// ErrUserAlreadyExists is also matched when that access entity is a user
+	ErrUserAlreadyExists = errors.New("user already exists")
+	// ErrUnknownUser is matched when a statement references a user that does not exist
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrUnknownRole is matched when a statement references a role that does not exist
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrAccessEntityNotFound is matched when a statement references an access entity that does not exist
+	ErrAccessEntityNotFound = errors.New("access entity not found")
+	// ErrAccessDenied is matched when the admin user lacks a privilege required by a statement
+	ErrAccessDenied = errors.New("access denied")
+	// ErrAuthenticationFailed is matched when ClickHouse rejects the admin credentials
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	// ErrDistributedDDLTimeout is matched when an ON CLUSTER statement exceeds distributed_ddl_task_timeout
+	ErrDistributedDDLTimeout = errors.New("distributed DDL timeout")
+)
+
+// StatementError is returned when a statement fails to execute. It keeps the
+// original error, usually a *clickhouse.Exception, and matches the sentinel
+// error of its exception code, so both errors.Is and errors.As work on it.
+type StatementError struct {
+	// Operation is the plugin operation running the statement, e.g. NewUser
+	Operation string
+	// Index is the position of the failing statement, starting at 0, once
+	// all the given statements have been split on ';'
+	Index int
+	Err   error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("unable to execute query. operation=%s statement=%d err=%v", e.Operation, e.Index, e.Err)
+}
+
+func (e *StatementError) Unwrap() []error {
+	return append(exceptionKinds(e.Err), e.Err)
+}
+
+// Code returns the ClickHouse exception code of the failure, or 0 when the
+// statement did not fail with a server exception.
+func (e *StatementError) Code() int32 {
+	var exception *clickhouse.Exception
+	if errors.As(e.Err, &exception) {
+		return exception.Code
+	}
+
+	return 0
+}
+
+// sanitizedError has the message of an error with the secrets of the
+// configuration masked. It unwraps to the masked copies of the errors that
+// error wraps, so errors.Is and errors.As still work on it.
+type sanitizedError struct {
+	msg  string
+	errs []error
+}
+
+func (e *sanitizedError) Error() string {
+	return e.msg
+}
+
+func (e *sanitizedError) Unwrap() []error {
+	return e.errs
+}
+
+// maskError returns err with mask applied to the messages of its chain. The
+// *StatementError and *clickhouse.Exception of the chain are copied with their
+// messages masked, and the other errors exposing a secret are replaced by a
+// *sanitizedError, so that no error unwrapped from the result leaks one.
+func maskError(err error, mask func(string) string) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *StatementError:
+		return &StatementError{Operation: e.Operation, Index: e.Index, Err: maskError(e.Err, mask)}
+	case *clickhouse.Exception:
+		exception := *e
+		exception.Message = mask(e.Message)
+		exception.StackTrace = mask(e.StackTrace)
+		exception.Nested = nil
+		for _, nested := range e.Nested {
+			nested.Message = mask(nested.Message)
+			nested.StackTrace = mask(nested.StackTrace)
+			exception.Nested = append(exception.Nested, nested)
+		}
+
+		return &exception
+	}
+
+	var wrapped []error
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		wrapped = []error{e.Unwrap()}
+	case interface{ Unwrap() []error }:
+		wrapped = e.Unwrap()
+	}
+	masked := make([]error, 0, len(wrapped))
+	changed := false
+	for _, w := range wrapped {
+		if w == nil {
+			continue
+		}
+		m := maskError(w, mask)
+		changed = changed || m != w
+		masked = append(masked, m)
+	}
+	msg := mask(err.Error())
+	if !changed && msg == err.Error() {
+		return err
+	}
+
+	return &sanitizedError{msg: msg, errs: masked}
+}
+
+// exceptionKinds maps a ClickHouse exception to the sentinel errors it matches
+func exceptionKinds(err error) []error {
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) {
+		return nil
+	}
+
+	switch exception.Code {
+	case codeAccessEntityAlreadyExists:
+		// e.g. user `bob`: cannot insert because user `bob` already exists
+		if strings.Contains(exception.Message, "because user `") {
+			return []error{ErrAccessEntityAlreadyExists, ErrUserAlreadyExists}
+		}
+
+		return []error{ErrAccessEntityAlreadyExists}
+	case codeUnknownUser:
+		return []error{ErrUnknownUser}
+	case codeUnknownRole:
+		return []error{ErrUnknownRole}
+	case codeAccessEntityNotFound:
+		return []error{ErrAccessEntityNotFound}
+	case codeAccessDenied:
+		return []error{ErrAccessDenied}
+	case codeAuthenticationFailed:
+		return []error{ErrAuthenticationFailed}
+	case codeTimeoutExceeded:
+		if strings.Contains(exception.Message, "distributed_ddl_task_timeout") {
+			return []error{ErrDistributedDDLTimeout}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatementError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantKind error
+		wantCode int32
+	}{
+		{
+			name:     "Should match ErrUserAlreadyExists",
+			err:      &clickhouse.Exception{Code: codeAccessEntityAlreadyExists, Message: "user `bob`: cannot insert because user `bob` already exists"},
+			wantKind: ErrUserAlreadyExists,
+			wantCode: codeAccessEntityAlreadyExists,
+		},
+		{
+			name:     "Should match ErrAccessEntityAlreadyExists",
+			err:      &clickhouse.Exception{Code: codeAccessEntityAlreadyExists, Message: "user `bob`: cannot insert because user `bob` already exists"},
+			wantKind: ErrAccessEntityAlreadyExists,
+			wantCode: codeAccessEntityAlreadyExists,
+		},
+		{
+			name:     "Should match ErrUnknownRole",
+			err:      &clickhouse.Exception{Code: codeUnknownRole, Message: "There is no role `readonly` in user directories"},
+			wantKind: ErrUnknownRole,
+			wantCode: codeUnknownRole,
+		},
+		{
+			name:     "Should match ErrAccessDenied",
+			err:      &clickhouse.Exception{Code: codeAccessDenied, Message: "vault: Not enough privileges"},
+			wantKind: ErrAccessDenied,
+			wantCode: codeAccessDenied,
+		},
+		{
+			name:     "Should match ErrDistributedDDLTimeout",
+			err:      &clickhouse.Exception{Code: codeTimeoutExceeded, Message: "Watching task /clickhouse/task_queue/ddl/query-0000000001 is executing longer than distributed_ddl_task_timeout (=180) seconds"},
+			wantKind: ErrDistributedDDLTimeout,
+			wantCode: codeTimeoutExceeded,
+		},
+		{
+			name:     "Should not match any kind on a plain timeout",
+			err:      &clickhouse.Exception{Code: codeTimeoutExceeded, Message: "Timeout exceeded: elapsed 30 seconds"},
+			wantKind: nil,
+			wantCode: codeTimeoutExceeded,
+		},
+		{
+			name:     "Should not match any kind on a non ClickHouse error",
+			err:      errors.New("connection refused"),
+			wantKind: nil,
+			wantCode: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error = &StatementError{Operation: operationNewUser, Index: 1, Err: tt.err}
+
+			require.ErrorIs(t, err, tt.err)
+			if tt.wantKind != nil {
+				require.ErrorIs(t, err, tt.wantKind)
+			}
+
+			var stmtErr *StatementError
+			require.ErrorAs(t, fmt.Errorf("wrapped: %w", err), &stmtErr)
+			require.Equal(t, tt.wantCode, stmtErr.Code())
+			require.Equal(t, 1, stmtErr.Index)
+			require.Equal(t, operationNewUser, stmtErr.Operation)
+
+			var exception *clickhouse.Exception
+			require.Equal(t, tt.wantCode != 0, errors.As(err, &exception))
+
+			require.Contains(t, err.Error(), "operation=NewUser statement=1")
+			require.Contains(t, err.Error(), tt.err.Error())
+		})
+	}
+}
+
+func TestStatementError_alreadyExists(t *testing.T) {
+	var err error = &StatementError{Operation: operationNewUser, Err: &clickhouse.Exception{
+		Code:    codeAccessEntityAlreadyExists,
+		Message: "settings profile `bob_profile`: cannot insert because settings profile `bob_profile` already exists",
+	}}
+
+	require.ErrorIs(t, err, ErrAccessEntityAlreadyExists)
+	require.NotErrorIs(t, err, ErrUserAlreadyExists)
+}
+
+func Test_maskError(t *testing.T) {
+	mask := func(msg string) string {
+		return strings.ReplaceAll(msg, "s3cr3t", "[password]")
+	}
+	exception := &clickhouse.Exception{Code: codeUnknownRole, Message: "There is no role `readonly`, password s3cr3t"}
+	err := fmt.Errorf("wrapped: %w", &StatementError{Operation: operationNewUser, Index: 1, Err: exception})
+
+	masked := maskError(err, mask)
+	require.Equal(t, "wrapped: unable to execute query. operation=NewUser statement=1 err=code: 511, message: There is no role `readonly`, password [password]", masked.Error())
+	require.ErrorIs(t, masked, ErrUnknownRole)
+	var stmtErr *StatementError
+	require.ErrorAs(t, masked, &stmtErr)
+	require.NotContains(t, stmtErr.Error(), "s3cr3t")
+	var maskedException *clickhouse.Exception
+	require.ErrorAs(t, masked, &maskedException)
+	require.Equal(t, codeUnknownRole, maskedException.Code)
+	require.NotContains(t, maskedException.Message, "s3cr3t")
+	// The original errors are left untouched
+	require.Contains(t, exception.Message, "s3cr3t")
+
+	plain := errors.New("connection refused")
+	require.Same(t, plain, maskError(plain, mask))
+}
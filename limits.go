@@ -0,0 +1,240 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// profileNameTemplate and quotaNameTemplate name the access entities
+	// holding the limits of a user, they are dropped along with it
+	profileNameTemplate = "{{name}}_profile"
+	quotaNameTemplate   = "{{name}}_quota"
+)
+
+var (
+	limitNameRegexp     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	quotaIntervalRegexp = regexp.MustCompile(`(?i)^\d+\s+(second|minute|hour|day|week|month|quarter|year)s?$`)
+)
+
+// userLimits is a structured creation statement, a JSON object declaring the
+// resource limits of the created user, e.g.
+//
+//	{"settings": {"max_memory_usage": 10000000000}, "quotas": [{"interval": "1 hour", "limits": {"queries": 100}}]}
+type userLimits struct {
+	// Settings are set in a settings profile dedicated to the user
+	Settings map[string]interface{} `json:"settings"`
+	// Quotas are the intervals of a quota dedicated to the user
+	Quotas []quotaInterval `json:"quotas"`
+	// Cluster runs the statements ON CLUSTER, the cluster of the
+	// configuration by default
+	Cluster string `json:"cluster"`
+}
+
+type quotaInterval struct {
+	Interval   string                 `json:"interval"`
+	Randomized bool                   `json:"randomized"`
+	Limits     map[string]json.Number `json:"limits"`
+}
+
+// isStructuredStatement reports whether stmt is a JSON object rather than SQL
+func isStructuredStatement(stmt string) bool {
+	return strings.HasPrefix(strings.TrimSpace(stmt), "{")
+}
+
+// parseUserLimits parses a structured creation statement
+func parseUserLimits(stmt string) (*userLimits, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(stmt)))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	limits := &userLimits{}
+	if err := decoder.Decode(limits); err != nil {
+		return nil, fmt.Errorf("invalid structured statement: %w", err)
+	}
+	if limits.Cluster != "" && !limitNameRegexp.MatchString(strings.Trim(limits.Cluster, "{}")) {
+		return nil, fmt.Errorf("invalid structured statement: invalid cluster %q", limits.Cluster)
+	}
+
+	return limits, nil
+}
+
+// onCluster returns the ON CLUSTER clause of the statements, if any
+func (l *userLimits) onCluster() string {
+	if l.Cluster == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" ON CLUSTER '%s'", l.Cluster)
+}
+
+// statements returns the statements creating the settings profile and the
+// quota of the user, templated with {{name}}
+func (l *userLimits) statements() ([]string, error) {
+	onCluster := l.onCluster()
+
+	var statements []string
+	if len(l.Settings) > 0 {
+		settings, err := renderSettings(l.Settings)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, fmt.Sprintf("CREATE SETTINGS PROFILE '%s'%s SETTINGS %s TO '{{name}}'",
+			profileNameTemplate, onCluster, settings))
+	}
+	if len(l.Quotas) > 0 {
+		intervals := make([]string, 0, len(l.Quotas))
+		for _, quota := range l.Quotas {
+			interval, err := quota.render()
+			if err != nil {
+				return nil, err
+			}
+			intervals = append(intervals, interval)
+		}
+		statements = append(statements, fmt.Sprintf("CREATE QUOTA '%s'%s %s TO '{{name}}'",
+			quotaNameTemplate, onCluster, strings.Join(intervals, ", ")))
+	}
+
+	return statements, nil
+}
+
+// dropStatements returns the statements dropping the settings profile and
+// the quota of the user if they exist, templated with {{name}}. Revocations
+// don't know the limits the user was created with, so both are dropped.
+func (l *userLimits) dropStatements() []string {
+	return []string{
+		fmt.Sprintf("DROP SETTINGS PROFILE IF EXISTS '%s'%s", profileNameTemplate, l.onCluster()),
+		fmt.Sprintf("DROP QUOTA IF EXISTS '%s'%s", quotaNameTemplate, l.onCluster()),
+	}
+}
+
+func (q quotaInterval) render() (string, error) {
+	if !quotaIntervalRegexp.MatchString(q.Interval) {
+		return "", fmt.Errorf("invalid quota interval %q", q.Interval)
+	}
+	if len(q.Limits) == 0 {
+		return "", fmt.Errorf("quota interval %q has no limits", q.Interval)
+	}
+	limits := make([]string, 0, len(q.Limits))
+	for _, name := range sortedKeys(q.Limits) {
+		if !limitNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("invalid quota limit %q", name)
+		}
+		if _, err := q.Limits[name].Float64(); err != nil {
+			return "", fmt.Errorf("invalid quota limit %s: %w", name, err)
+		}
+		limits = append(limits, fmt.Sprintf("%s = %s", name, q.Limits[name]))
+	}
+	randomized := ""
+	if q.Randomized {
+		randomized = "RANDOMIZED "
+	}
+
+	return fmt.Sprintf("FOR %sINTERVAL %s MAX %s", randomized, q.Interval, strings.Join(limits, ", ")), nil
+}
+
+func renderSettings(settings map[string]interface{}) (string, error) {
+	rendered := make([]string, 0, len(settings))
+	for _, name := range sortedKeys(settings) {
+		if !limitNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("invalid setting %q", name)
+		}
+		var value string
+		switch v := settings[name].(type) {
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = fmt.Sprint(v)
+		case string:
+			// statements are split on ';'
+			if strings.Contains(v, ";") {
+				return "", fmt.Errorf("invalid setting %s: value cannot contain ';'", name)
+			}
+			value = "'" + escapeStringLiteral(v) + "'"
+		default:
+			return "", fmt.Errorf("invalid setting %s: unsupported value %v", name, v)
+		}
+		rendered = append(rendered, fmt.Sprintf("%s = %s", name, value))
+	}
+
+	return strings.Join(rendered, ", "), nil
+}
+
+// splitStructuredStatements returns the SQL creation statements, followed by
+// the statements generated from the structured ones, which need the user to
+// exist already. They run ON CLUSTER cluster unless they name another one.
+func splitStructuredStatements(commands []string, cluster string) ([]string, error) {
+	var sqlStatements, generated []string
+	for _, stmt := range commands {
+		if !isStructuredStatement(stmt) {
+			sqlStatements = append(sqlStatements, stmt)
+
+			continue
+		}
+		limits, err := parseUserLimits(stmt)
+		if err != nil {
+			return nil, err
+		}
+		if limits.Cluster == "" {
+			limits.Cluster = cluster
+		}
+		statements, err := limits.statements()
+		if err != nil {
+			return nil, fmt.Errorf("invalid structured statement: %w", err)
+		}
+		generated = append(generated, statements...)
+	}
+
+	return append(sqlStatements, generated...), nil
+}
+
+// splitStructuredRevocationStatements returns the SQL revocation statements,
+// the default ones if there are none, followed by the statements dropping the
+// settings profile and the quota of the user ON CLUSTER cluster. A structured
+// statement names another cluster, on which the default statements also run.
+func splitStructuredRevocationStatements(commands []string, cluster string) ([]string, error) {
+	var sqlStatements []string
+	limits := &userLimits{}
+	for _, stmt := range commands {
+		if !isStructuredStatement(stmt) {
+			sqlStatements = append(sqlStatements, stmt)
+
+			continue
+		}
+		parsed, err := parseUserLimits(stmt)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Cluster != "" {
+			limits.Cluster = parsed.Cluster
+		}
+	}
+	if len(sqlStatements) == 0 {
+		sqlStatements = []string{fmt.Sprintf("DROP USER IF EXISTS '{{name}}'%s", limits.onCluster())}
+	}
+	if limits.Cluster == "" {
+		limits.Cluster = cluster
+	}
+
+	return append(sqlStatements, limits.dropStatements()...), nil
+}
+
+// checkStructuredStatements rejects the structured statements of commands
+// unless user limits are enabled, their settings profiles and quotas would
+// not be dropped otherwise
+func checkStructuredStatements(commands []string, userLimits bool) error {
+	if !userLimits && slices.ContainsFunc(commands, isStructuredStatement) {
+		return errors.New("structured statements declaring user limits need user_limits to be enabled")
+	}
+
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
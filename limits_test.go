@@ -0,0 +1,163 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_splitStructuredStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		cluster  string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "Should keep SQL statements as is",
+			commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT readonly TO '{{name}}'"},
+			want:     []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'; GRANT readonly TO '{{name}}'"},
+		},
+		{
+			name: "Should create a settings profile and a quota after the SQL statements",
+			commands: []string{
+				`{"settings": {"max_memory_usage": 10000000000, "readonly": 2, "log_comment": "it's vault"}, "quotas": [{"interval": "1 hour", "limits": {"queries": 100, "errors": 10}}]}`,
+				"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'",
+			},
+			want: []string{
+				"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'",
+				`CREATE SETTINGS PROFILE '{{name}}_profile' SETTINGS log_comment = 'it\'s vault', max_memory_usage = 10000000000, readonly = 2 TO '{{name}}'`,
+				"CREATE QUOTA '{{name}}_quota' FOR INTERVAL 1 hour MAX errors = 10, queries = 100 TO '{{name}}'",
+			},
+		},
+		{
+			name: "Should create randomized quota intervals on cluster",
+			commands: []string{
+				"CREATE USER '{{name}}' ON CLUSTER '{cluster}' IDENTIFIED BY '{{password}}'",
+				`{"cluster": "{cluster}", "quotas": [{"interval": "1 hour", "randomized": true, "limits": {"queries": 100}}, {"interval": "1 day", "limits": {"execution_time": 3600.5}}]}`,
+			},
+			want: []string{
+				"CREATE USER '{{name}}' ON CLUSTER '{cluster}' IDENTIFIED BY '{{password}}'",
+				"CREATE QUOTA '{{name}}_quota' ON CLUSTER '{cluster}' FOR RANDOMIZED INTERVAL 1 hour MAX queries = 100, FOR INTERVAL 1 day MAX execution_time = 3600.5 TO '{{name}}'",
+			},
+		},
+		{
+			name: "Should create the limits on the configured cluster",
+			commands: []string{
+				"CREATE USER '{{name}}' ON CLUSTER 'main' IDENTIFIED BY '{{password}}'",
+				`{"settings": {"readonly": 2}}`,
+			},
+			cluster: "main",
+			want: []string{
+				"CREATE USER '{{name}}' ON CLUSTER 'main' IDENTIFIED BY '{{password}}'",
+				"CREATE SETTINGS PROFILE '{{name}}_profile' ON CLUSTER 'main' SETTINGS readonly = 2 TO '{{name}}'",
+			},
+		},
+		{
+			name:     "Should reject invalid JSON",
+			commands: []string{`{"settings": `},
+			wantErr:  true,
+		},
+		{
+			name:     "Should reject unknown fields",
+			commands: []string{`{"profile": "default"}`},
+			wantErr:  true,
+		},
+		{
+			name:     "Should reject an invalid setting name",
+			commands: []string{`{"settings": {"readonly = 0, max_threads": 1}}`},
+			wantErr:  true,
+		},
+		{
+			name:     "Should reject a setting value splitting the statement",
+			commands: []string{`{"settings": {"log_comment": "a'; DROP USER admin; --"}}`},
+			wantErr:  true,
+		},
+		{
+			name:     "Should reject an invalid quota interval",
+			commands: []string{`{"quotas": [{"interval": "forever", "limits": {"queries": 100}}]}`},
+			wantErr:  true,
+		},
+		{
+			name:     "Should reject a quota interval without limits",
+			commands: []string{`{"quotas": [{"interval": "1 hour"}]}`},
+			wantErr:  true,
+		},
+		{
+			name:     "Should reject an invalid cluster",
+			commands: []string{`{"cluster": "a' TO admin", "settings": {"readonly": 1}}`},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitStructuredStatements(tt.commands, tt.cluster)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitStructuredStatements() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_splitStructuredRevocationStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands []string
+		cluster  string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "Should drop the limits after the SQL statements",
+			commands: []string{"REVOKE readonly FROM '{{name}}'; DROP USER '{{name}}'"},
+			want: []string{
+				"REVOKE readonly FROM '{{name}}'; DROP USER '{{name}}'",
+				"DROP SETTINGS PROFILE IF EXISTS '{{name}}_profile'",
+				"DROP QUOTA IF EXISTS '{{name}}_quota'",
+			},
+		},
+		{
+			name:     "Should drop the limits on the configured cluster",
+			commands: []string{"DROP USER IF EXISTS '{{name}}' ON CLUSTER 'main'"},
+			cluster:  "main",
+			want: []string{
+				"DROP USER IF EXISTS '{{name}}' ON CLUSTER 'main'",
+				"DROP SETTINGS PROFILE IF EXISTS '{{name}}_profile' ON CLUSTER 'main'",
+				"DROP QUOTA IF EXISTS '{{name}}_quota' ON CLUSTER 'main'",
+			},
+		},
+		{
+			name:     "Should drop the user and its limits on the cluster of a structured statement",
+			commands: []string{`{"cluster": "{cluster}"}`},
+			cluster:  "main",
+			want: []string{
+				"DROP USER IF EXISTS '{{name}}' ON CLUSTER '{cluster}'",
+				"DROP SETTINGS PROFILE IF EXISTS '{{name}}_profile' ON CLUSTER '{cluster}'",
+				"DROP QUOTA IF EXISTS '{{name}}_quota' ON CLUSTER '{cluster}'",
+			},
+		},
+		{
+			name:     "Should reject an invalid cluster",
+			commands: []string{`{"cluster": "a' TO admin", "settings": {"readonly": 1}}`},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitStructuredRevocationStatements(tt.commands, tt.cluster)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitStructuredRevocationStatements() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_checkStructuredStatements(t *testing.T) {
+	commands := []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'", `{"settings": {"readonly": 2}}`}
+	require.NoError(t, checkStructuredStatements(commands, true))
+	require.NoError(t, checkStructuredStatements(commands[:1], false))
+	require.ErrorContains(t, checkStructuredStatements(commands, false), "need user_limits to be enabled")
+}
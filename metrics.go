@@ -0,0 +1,66 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+
+	// errorCodeNone labels metrics of operations that did not fail with a
+	// ClickHouse exception
+	errorCodeNone = "none"
+)
+
+// emitOperationMetrics records the duration and the outcome of a credential
+// operation, labelled with the ClickHouse exception code it failed with
+func emitOperationMetrics(operation string, start time.Time, err error) {
+	labels := []metrics.Label{
+		{Name: "operation", Value: operation},
+		{Name: "outcome", Value: outcome(err)},
+		{Name: "error_code", Value: errorCode(err)},
+	}
+	metrics.MeasureSinceWithLabels([]string{"clickhouse", "operation", "duration"}, start, labels)
+	metrics.IncrCounterWithLabels([]string{"clickhouse", "operation", "count"}, 1, labels)
+}
+
+// emitConnectionMetrics records how long getting a connection took
+func emitConnectionMetrics(start time.Time, err error) {
+	labels := []metrics.Label{
+		{Name: "outcome", Value: outcome(err)},
+	}
+	metrics.MeasureSinceWithLabels([]string{"clickhouse", "connection", "duration"}, start, labels)
+	metrics.IncrCounterWithLabels([]string{"clickhouse", "connection", "count"}, 1, labels)
+}
+
+// emitPoolMetrics records the connection pool statistics
+func emitPoolMetrics(stats sql.DBStats) {
+	metrics.SetGauge([]string{"clickhouse", "pool", "open_connections"}, float32(stats.OpenConnections))
+	metrics.SetGauge([]string{"clickhouse", "pool", "in_use"}, float32(stats.InUse))
+	metrics.SetGauge([]string{"clickhouse", "pool", "idle"}, float32(stats.Idle))
+	metrics.SetGauge([]string{"clickhouse", "pool", "wait_count"}, float32(stats.WaitCount))
+	metrics.SetGauge([]string{"clickhouse", "pool", "wait_duration_ms"}, float32(stats.WaitDuration.Milliseconds()))
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeFailure
+	}
+
+	return outcomeSuccess
+}
+
+func errorCode(err error) string {
+	var stmtErr *StatementError
+	if errors.As(err, &stmtErr) && stmtErr.Code() != 0 {
+		return strconv.Itoa(int(stmtErr.Code()))
+	}
+
+	return errorCodeNone
+}
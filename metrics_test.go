@@ -0,0 +1,80 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	metrics "github.com/armon/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMetricsSink(t *testing.T) *metrics.InmemSink {
+	t.Helper()
+
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("vault")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	if _, err := metrics.NewGlobal(conf, sink); err != nil {
+		t.Fatalf("unable to set the global metrics sink. err=%v", err.Error())
+	}
+	t.Cleanup(func() {
+		_, _ = metrics.NewGlobal(metrics.DefaultConfig("vault"), &metrics.BlackholeSink{})
+	})
+
+	return sink
+}
+
+func Test_emitOperationMetrics(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCounter string
+	}{
+		{
+			name:        "Should label a success",
+			err:         nil,
+			wantCounter: "vault.clickhouse.operation.count;operation=NewUser;outcome=success;error_code=none",
+		},
+		{
+			name: "Should label a failure with its ClickHouse exception code",
+			err: &StatementError{
+				Operation: operationNewUser,
+				Err:       &clickhouse.Exception{Code: codeAccessEntityAlreadyExists},
+			},
+			wantCounter: "vault.clickhouse.operation.count;operation=NewUser;outcome=failure;error_code=493",
+		},
+		{
+			name:        "Should label a failure without ClickHouse exception",
+			err:         errors.New("connection refused"),
+			wantCounter: "vault.clickhouse.operation.count;operation=NewUser;outcome=failure;error_code=none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newTestMetricsSink(t)
+
+			emitOperationMetrics(operationNewUser, time.Now(), tt.err)
+
+			data := sink.Data()
+			require.NotEmpty(t, data)
+			require.Contains(t, data[0].Counters, tt.wantCounter)
+			require.Equal(t, 1, data[0].Counters[tt.wantCounter].Count)
+		})
+	}
+}
+
+func Test_emitPoolMetrics(t *testing.T) {
+	sink := newTestMetricsSink(t)
+
+	emitPoolMetrics(sql.DBStats{OpenConnections: 3, InUse: 1, Idle: 2})
+
+	data := sink.Data()
+	require.NotEmpty(t, data)
+	require.InDelta(t, float32(3), data[0].Gauges["vault.clickhouse.pool.open_connections"].Value, 0)
+	require.InDelta(t, float32(1), data[0].Gauges["vault.clickhouse.pool.in_use"].Value, 0)
+	require.InDelta(t, float32(2), data[0].Gauges["vault.clickhouse.pool.idle"].Value, 0)
+}
@@ -0,0 +1,85 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// passwordComplexityRule mirrors a <rule> of the <password_complexity> section
+// of the ClickHouse server configuration
+type passwordComplexityRule struct {
+	Pattern string `json:"pattern" mapstructure:"pattern"`
+	Message string `json:"message" mapstructure:"message"`
+
+	regexp *regexp.Regexp
+}
+
+// PasswordComplexityError is returned when the password generated by Vault
+// does not satisfy the password complexity rules of the ClickHouse server.
+type PasswordComplexityError struct {
+	// Unmet are the messages of the rules the password does not satisfy
+	Unmet []string
+}
+
+func (e *PasswordComplexityError) Error() string {
+	return fmt.Sprintf("the password does not satisfy the ClickHouse password complexity rules, "+
+		"update the password_policy of the database secrets engine so that the password should: %s",
+		strings.Join(e.Unmet, ", "))
+}
+
+// parsePasswordComplexityRules parses the password_complexity_rules config
+// field, either a list of {pattern, message} objects or its JSON encoding.
+func parsePasswordComplexityRules(raw interface{}) ([]passwordComplexityRule, error) {
+	var rules []passwordComplexityRule
+	switch raw := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if strings.TrimSpace(raw) == "" {
+			return nil, nil
+		}
+		if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+			return nil, fmt.Errorf("invalid password_complexity_rules: %w", err)
+		}
+	default:
+		if err := mapstructure.Decode(raw, &rules); err != nil {
+			return nil, fmt.Errorf("invalid password_complexity_rules: %w", err)
+		}
+	}
+
+	for i := range rules {
+		if rules[i].Pattern == "" {
+			return nil, fmt.Errorf("invalid password_complexity_rules: rule %d has no pattern", i)
+		}
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid password_complexity_rules: rule %d: %w", i, err)
+		}
+		rules[i].regexp = re
+		if rules[i].Message == "" {
+			rules[i].Message = "match " + rules[i].Pattern
+		}
+	}
+
+	return rules, nil
+}
+
+// validatePassword checks password against the password complexity rules,
+// as the server would, so that it is not rejected by an opaque DDL failure.
+func (c *clickhouseConnectionProducer) validatePassword(password string) error {
+	var unmet []string
+	for _, rule := range c.passwordComplexityRules {
+		if !rule.regexp.MatchString(password) {
+			unmet = append(unmet, rule.Message)
+		}
+	}
+	if len(unmet) > 0 {
+		return &PasswordComplexityError{Unmet: unmet}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parsePasswordComplexityRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		raw          interface{}
+		wantMessages []string
+		wantErr      bool
+	}{
+		{
+			name: "Should not set rules by default",
+			raw:  nil,
+		},
+		{
+			name: "Should parse a JSON string",
+			raw:  `[{"pattern": ".{12}", "message": "be at least 12 characters long"}, {"pattern": "\\p{N}"}]`,
+			wantMessages: []string{
+				"be at least 12 characters long",
+				`match \p{N}`,
+			},
+		},
+		{
+			name: "Should parse a list of rules",
+			raw: []interface{}{
+				map[string]interface{}{"pattern": "\\p{Lu}", "message": "contain at least 1 uppercase character"},
+			},
+			wantMessages: []string{"contain at least 1 uppercase character"},
+		},
+		{
+			name:    "Should reject invalid JSON",
+			raw:     `[{"pattern": `,
+			wantErr: true,
+		},
+		{
+			name:    "Should reject a rule without pattern",
+			raw:     `[{"message": "be long"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Should reject an invalid pattern",
+			raw:     `[{"pattern": "(", "message": "be long"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePasswordComplexityRules(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePasswordComplexityRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var messages []string
+			for _, rule := range got {
+				messages = append(messages, rule.Message)
+			}
+			require.Equal(t, tt.wantMessages, messages)
+		})
+	}
+}
+
+func TestClickhouse_passwordComplexity(t *testing.T) {
+	db := newClickhouse(DefaultUserNameTemplate)
+	_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{
+		Config: map[string]interface{}{
+			"connection_url": "tcp://someHost:9000",
+			"password_complexity_rules": `[
+				{"pattern": ".{12}", "message": "be at least 12 characters long"},
+				{"pattern": "\\p{N}", "message": "contain at least 1 numeric character"},
+				{"pattern": "[^\\p{L}\\p{N}]", "message": "contain at least 1 special character"}
+			]`,
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		password  string
+		wantUnmet []string
+	}{
+		{
+			name:      "Should report every unmet rule",
+			password:  "short",
+			wantUnmet: []string{"be at least 12 characters long", "contain at least 1 numeric character", "contain at least 1 special character"},
+		},
+		{
+			name:      "Should report a single unmet rule",
+			password:  "longEnough123",
+			wantUnmet: []string{"contain at least 1 special character"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The password is validated before any statement runs, no server is needed
+			_, err := db.NewUser(t.Context(), dbplugin.NewUserRequest{
+				Statements: dbplugin.Statements{Commands: []string{"CREATE USER '{{name}}' IDENTIFIED BY '{{password}}'"}},
+				Password:   tt.password,
+			})
+			var complexityErr *PasswordComplexityError
+			require.ErrorAs(t, err, &complexityErr)
+			require.Equal(t, tt.wantUnmet, complexityErr.Unmet)
+			require.Contains(t, err.Error(), "password_policy")
+
+			_, err = db.UpdateUser(t.Context(), dbplugin.UpdateUserRequest{
+				Username: "bob",
+				Password: &dbplugin.ChangePassword{NewPassword: tt.password},
+			})
+			require.ErrorAs(t, err, &complexityErr)
+			require.Equal(t, tt.wantUnmet, complexityErr.Unmet)
+		})
+	}
+
+	require.NoError(t, db.validatePassword("longEnough123!"))
+}
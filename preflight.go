@@ -0,0 +1,170 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	privilegeAll              = "ALL"
+	privilegeAccessManagement = "ACCESS MANAGEMENT"
+	privilegeRoleAdmin        = "ROLE ADMIN"
+	privilegeCluster          = "CLUSTER"
+)
+
+// adminGrants are the global privileges of the admin user, and the roles it
+// can grant with ADMIN OPTION, its enabled roles included
+type adminGrants struct {
+	user        string
+	privileges  map[string]bool
+	adminOption map[string]bool
+}
+
+// MissingPrivilegesError is returned when the connection is verified and the
+// admin user lacks privileges needed to manage users.
+type MissingPrivilegesError struct {
+	User    string
+	Missing []string
+}
+
+func (e *MissingPrivilegesError) Error() string {
+	return fmt.Sprintf("admin user %s is missing privileges: %s", e.User, strings.Join(e.Missing, ", "))
+}
+
+// has reports whether the admin holds privilege, directly or through one of
+// the privileges including it
+func (g *adminGrants) has(privilege string, including ...string) bool {
+	if g.privileges[privilege] || g.privileges[privilegeAll] {
+		return true
+	}
+	for _, p := range including {
+		if g.privileges[p] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// missingPrivileges lists the privileges the admin needs to run the default
+// statements, the ones of user limits if enabled, to grant roles, and to run
+// ON CLUSTER statements if cluster is set
+func (g *adminGrants) missingPrivileges(cluster string, roles []string, userLimits bool) []string {
+	missing := g.missingAccessManagement("CREATE USER", "ALTER USER", "DROP USER")
+	if userLimits {
+		missing = append(missing, g.missingLimitPrivileges()...)
+	}
+	if !g.has(privilegeRoleAdmin, privilegeAccessManagement) {
+		for _, role := range roles {
+			if !g.adminOption[role] {
+				missing = append(missing, fmt.Sprintf("%s or ADMIN OPTION on role %s", privilegeRoleAdmin, role))
+			}
+		}
+	}
+	if cluster != "" && !g.has(privilegeCluster) {
+		missing = append(missing, privilegeCluster)
+	}
+
+	return missing
+}
+
+// missingLimitPrivileges lists the privileges the admin needs to create and
+// drop the settings profiles and quotas of user limits
+func (g *adminGrants) missingLimitPrivileges() []string {
+	return g.missingAccessManagement("CREATE SETTINGS PROFILE", "DROP SETTINGS PROFILE", "CREATE QUOTA", "DROP QUOTA")
+}
+
+// missingAccessManagement lists the privileges the admin lacks, ACCESS
+// MANAGEMENT including them all
+func (g *adminGrants) missingAccessManagement(privileges ...string) []string {
+	var missing []string
+	for _, privilege := range privileges {
+		if !g.has(privilege, privilegeAccessManagement) {
+			missing = append(missing, privilege)
+		}
+	}
+
+	return missing
+}
+
+// checkPrivileges fails with a *MissingPrivilegesError if the admin user
+// cannot manage users, their limits if userLimits is set, grant roles, or run
+// statements ON CLUSTER cluster. The privileges of user limits are only
+// logged as missing otherwise.
+func checkPrivileges(ctx context.Context, db *sql.DB, logger hclog.Logger, cluster string, roles []string, userLimits bool) error {
+	grants, err := queryAdminGrants(ctx, db)
+	if err != nil {
+		return err
+	}
+	if cluster != "" && !strings.Contains(cluster, "{") {
+		var count uint64
+		if err = db.QueryRowContext(ctx, "SELECT count() FROM system.clusters WHERE cluster = ?", cluster).Scan(&count); err != nil {
+			return fmt.Errorf("unable to query the clusters: %w", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("cluster %s not found in system.clusters", cluster)
+		}
+	}
+	if missing := grants.missingPrivileges(cluster, roles, userLimits); len(missing) > 0 {
+		return &MissingPrivilegesError{User: grants.user, Missing: missing}
+	}
+	if missing := grants.missingLimitPrivileges(); !userLimits && len(missing) > 0 {
+		logger.Warn("admin user cannot manage user limits, do not enable user_limits", "user", grants.user, "missing", missing)
+	}
+
+	return nil
+}
+
+func queryAdminGrants(ctx context.Context, db *sql.DB) (*adminGrants, error) {
+	grants := &adminGrants{
+		privileges:  map[string]bool{},
+		adminOption: map[string]bool{},
+	}
+	if err := db.QueryRowContext(ctx, "SELECT currentUser()").Scan(&grants.user); err != nil {
+		return nil, fmt.Errorf("unable to query the current user: %w", err)
+	}
+
+	const grantee = "(user_name = currentUser() OR role_name IN (SELECT role_name FROM system.enabled_roles))"
+	privileges, err := queryStrings(ctx, db, "SELECT access_type FROM system.grants WHERE "+grantee+
+		" AND database IS NULL AND is_partial_revoke = 0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query the grants: %w", err)
+	}
+	for _, privilege := range privileges {
+		grants.privileges[privilege] = true
+	}
+
+	roles, err := queryStrings(ctx, db, "SELECT granted_role_name FROM system.role_grants WHERE "+grantee+
+		" AND with_admin_option = 1")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query the role grants: %w", err)
+	}
+	for _, role := range roles {
+		grants.adminOption[role] = true
+	}
+
+	return grants, nil
+}
+
+// queryStrings returns the single string column of the rows of query
+func queryStrings(ctx context.Context, db *sql.DB, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
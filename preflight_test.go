@@ -0,0 +1,87 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_adminGrants_missingPrivileges(t *testing.T) {
+	tests := []struct {
+		name        string
+		privileges  []string
+		adminOption []string
+		cluster     string
+		roles       []string
+		userLimits  bool
+		wantMissing []string
+	}{
+		{
+			name:       "Should accept ALL",
+			privileges: []string{"ALL"},
+			cluster:    "my_cluster",
+			roles:      []string{"readonly"},
+		},
+		{
+			name:       "Should accept ACCESS MANAGEMENT without cluster",
+			privileges: []string{"ACCESS MANAGEMENT"},
+			roles:      []string{"readonly"},
+		},
+		{
+			name:       "Should report every missing privilege",
+			privileges: []string{"SELECT"},
+			cluster:    "my_cluster",
+			roles:      []string{"readonly"},
+			userLimits: true,
+			wantMissing: []string{
+				"CREATE USER", "ALTER USER", "DROP USER",
+				"CREATE SETTINGS PROFILE", "DROP SETTINGS PROFILE", "CREATE QUOTA", "DROP QUOTA",
+				"ROLE ADMIN or ADMIN OPTION on role readonly", "CLUSTER",
+			},
+		},
+		{
+			name:        "Should accept roles granted with ADMIN OPTION",
+			privileges:  []string{"CREATE USER", "ALTER USER", "DROP USER"},
+			adminOption: []string{"readonly"},
+			roles:       []string{"readonly", "writer"},
+			wantMissing: []string{"ROLE ADMIN or ADMIN OPTION on role writer"},
+		},
+		{
+			name:        "Should require the settings profile and quota privileges of user limits",
+			privileges:  []string{"CREATE USER", "ALTER USER", "DROP USER"},
+			userLimits:  true,
+			wantMissing: []string{"CREATE SETTINGS PROFILE", "DROP SETTINGS PROFILE", "CREATE QUOTA", "DROP QUOTA"},
+		},
+		{
+			name:       "Should not require the privileges of user limits unless enabled",
+			privileges: []string{"CREATE USER", "ALTER USER", "DROP USER"},
+		},
+		{
+			name:        "Should require CLUSTER when a cluster is configured",
+			privileges:  []string{"ACCESS MANAGEMENT"},
+			cluster:     "my_cluster",
+			wantMissing: []string{"CLUSTER"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &adminGrants{
+				user:        "admin",
+				privileges:  map[string]bool{},
+				adminOption: map[string]bool{},
+			}
+			for _, p := range tt.privileges {
+				g.privileges[p] = true
+			}
+			for _, r := range tt.adminOption {
+				g.adminOption[r] = true
+			}
+			require.Equal(t, tt.wantMissing, g.missingPrivileges(tt.cluster, tt.roles, tt.userLimits))
+		})
+	}
+}
+
+func TestMissingPrivilegesError_Error(t *testing.T) {
+	err := &MissingPrivilegesError{User: "admin", Missing: []string{"CREATE USER", "CLUSTER"}}
+	require.Equal(t, "admin user admin is missing privileges: CREATE USER, CLUSTER", err.Error())
+}
@@ -0,0 +1,138 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/cenkalti/backoff/v3"
+)
+
+const (
+	defaultRetryInitialInterval = "500ms"
+	defaultRetryMaxInterval     = "5s"
+	defaultRetryMaxElapsedTime  = "30s"
+)
+
+// retryPolicy describes how a failing statement is retried
+type retryPolicy struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxElapsedTime  time.Duration
+}
+
+// enabled reports whether the policy allows any retry at all
+func (p retryPolicy) enabled() bool {
+	return p.maxElapsedTime > 0
+}
+
+func (p retryPolicy) newBackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.initialInterval
+	b.MaxInterval = p.maxInterval
+	b.MaxElapsedTime = p.maxElapsedTime
+	b.Reset()
+
+	return b
+}
+
+// do runs op until it succeeds, returns a non retriable error, or the policy
+// gives up. Only idempotent queries are retried. It never waits past the
+// deadline of ctx: the last error is returned instead. notify, when not nil,
+// is called before each retry.
+func (p retryPolicy) do(ctx context.Context, query string, op func() error, notify backoff.Notify) error {
+	err := op()
+	if err == nil || !p.enabled() || !isIdempotentQuery(query) {
+		return err
+	}
+
+	b := p.newBackOff()
+	for isRetriableError(err) {
+		wait := b.NextBackOff()
+		if wait == backoff.Stop {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		if notify != nil {
+			notify(err, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return err
+		case <-timer.C:
+		}
+
+		if err = op(); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// isIdempotentQuery reports whether running query more than once has the same
+// effect as running it once, which is the case for IF [NOT] EXISTS statements.
+func isIdempotentQuery(query string) bool {
+	normalized := strings.ToUpper(strings.Join(strings.Fields(query), " "))
+
+	return strings.Contains(normalized, " IF EXISTS ") || strings.Contains(normalized, " IF NOT EXISTS ")
+}
+
+// isRetriableError classifies err into transient (keeper session expiry,
+// distributed DDL timeouts, network failures...) or fatal.
+func isRetriableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return isRetriableExceptionCode(exception.Code)
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return strings.Contains(err.Error(), "connection reset")
+}
+
+func isRetriableExceptionCode(code int32) bool {
+	switch code {
+	case codeTimeoutExceeded,
+		codeTooManySimultaneousQueries,
+		codeNoFreeConnection,
+		codeSocketTimeout,
+		codeNetworkError,
+		codeNoZooKeeper,
+		codeTableIsReadOnly,
+		codeAllConnectionTriesFailed,
+		codeKeeperException:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,198 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isIdempotentQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{
+			name:  "Should accept DROP USER IF EXISTS",
+			query: "DROP USER IF EXISTS 'bob'",
+			want:  true,
+		},
+		{
+			name:  "Should accept CREATE USER IF NOT EXISTS regardless of case and spacing",
+			query: "create user if  not\n\texists 'bob' IDENTIFIED BY 'secret'",
+			want:  true,
+		},
+		{
+			name:  "Should reject plain CREATE USER",
+			query: "CREATE USER 'bob' IDENTIFIED BY 'secret'",
+			want:  false,
+		},
+		{
+			name:  "Should reject GRANT",
+			query: "GRANT SELECT ON *.* TO 'bob'",
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIdempotentQuery(tt.query); got != tt.want {
+				t.Errorf("isIdempotentQuery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isRetriableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "Should retry distributed DDL timeouts",
+			err:  &clickhouse.Exception{Code: codeTimeoutExceeded, Name: "DB::Exception"},
+			want: true,
+		},
+		{
+			name: "Should retry keeper exceptions wrapped in another error",
+			err:  fmt.Errorf("exec: %w", &clickhouse.Exception{Code: codeKeeperException}),
+			want: true,
+		},
+		{
+			name: "Should not retry syntax errors",
+			err:  &clickhouse.Exception{Code: 62},
+			want: false,
+		},
+		{
+			name: "Should retry connection resets",
+			err:  fmt.Errorf("read: %w", syscall.ECONNRESET),
+			want: true,
+		},
+		{
+			name: "Should retry unexpected EOF",
+			err:  io.ErrUnexpectedEOF,
+			want: true,
+		},
+		{
+			name: "Should not retry a canceled context",
+			err:  context.Canceled,
+			want: false,
+		},
+		{
+			name: "Should not retry unknown errors",
+			err:  errors.New("something went wrong"),
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetriableError(tt.err); got != tt.want {
+				t.Errorf("isRetriableError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_retryPolicy_do(t *testing.T) {
+	policy := retryPolicy{
+		initialInterval: time.Millisecond,
+		maxInterval:     time.Millisecond,
+		maxElapsedTime:  time.Second,
+	}
+	transient := &clickhouse.Exception{Code: codeNetworkError}
+
+	tests := []struct {
+		name      string
+		policy    retryPolicy
+		query     string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "Should retry an idempotent statement until it succeeds",
+			policy:    policy,
+			query:     "DROP USER IF EXISTS 'bob'",
+			failures:  2,
+			err:       transient,
+			wantCalls: 3,
+			wantErr:   false,
+		},
+		{
+			name:      "Should not retry a non idempotent statement",
+			policy:    policy,
+			query:     "CREATE USER 'bob'",
+			failures:  2,
+			err:       transient,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "Should not retry a fatal error",
+			policy:    policy,
+			query:     "DROP USER IF EXISTS 'bob'",
+			failures:  2,
+			err:       &clickhouse.Exception{Code: 62},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "Should not retry when retries are disabled",
+			policy:    retryPolicy{},
+			query:     "DROP USER IF EXISTS 'bob'",
+			failures:  2,
+			err:       transient,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := tt.policy.do(t.Context(), tt.query, func() error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+
+				return nil
+			}, nil)
+			require.Equal(t, tt.wantCalls, calls)
+			if tt.wantErr {
+				require.ErrorIs(t, err, tt.err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_retryPolicy_do_respectsDeadline(t *testing.T) {
+	policy := retryPolicy{
+		initialInterval: time.Minute,
+		maxInterval:     time.Minute,
+		maxElapsedTime:  time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+
+	transient := &clickhouse.Exception{Code: codeNetworkError}
+	calls := 0
+	start := time.Now()
+	err := policy.do(ctx, "DROP USER IF EXISTS 'bob'", func() error {
+		calls++
+
+		return transient
+	}, nil)
+	require.ErrorIs(t, err, transient)
+	require.Equal(t, 1, calls)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,63 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+var (
+	_ dbplugin.Database       = (*errorSanitizerMiddleware)(nil)
+	_ logical.PluginVersioner = (*errorSanitizerMiddleware)(nil)
+)
+
+// errorSanitizerMiddleware masks the secrets of the configuration, and the
+// password of the request, in the errors of the plugin. Unlike the one of the
+// SDK, which rebuilds them with errors.New, it keeps their chain masked too,
+// so that Vault and tooling can still match them with errors.Is and errors.As.
+type errorSanitizerMiddleware struct {
+	next *Clickhouse
+}
+
+func (mw *errorSanitizerMiddleware) Initialize(ctx context.Context, req dbplugin.InitializeRequest) (dbplugin.InitializeResponse, error) {
+	resp, err := mw.next.Initialize(ctx, req)
+
+	return resp, mw.next.sanitizeError(err, nil)
+}
+
+func (mw *errorSanitizerMiddleware) NewUser(ctx context.Context, req dbplugin.NewUserRequest) (dbplugin.NewUserResponse, error) {
+	resp, err := mw.next.NewUser(ctx, req)
+
+	return resp, mw.next.sanitizeError(err, map[string]string{"password": req.Password})
+}
+
+func (mw *errorSanitizerMiddleware) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
+	resp, err := mw.next.UpdateUser(ctx, req)
+	var queryMap map[string]string
+	if req.Password != nil {
+		queryMap = map[string]string{"password": req.Password.NewPassword}
+	}
+
+	return resp, mw.next.sanitizeError(err, queryMap)
+}
+
+func (mw *errorSanitizerMiddleware) DeleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
+	resp, err := mw.next.DeleteUser(ctx, req)
+
+	return resp, mw.next.sanitizeError(err, nil)
+}
+
+func (mw *errorSanitizerMiddleware) Type() (string, error) {
+	dbType, err := mw.next.Type()
+
+	return dbType, mw.next.sanitizeError(err, nil)
+}
+
+func (mw *errorSanitizerMiddleware) Close() error {
+	return mw.next.sanitizeError(mw.next.Close(), nil)
+}
+
+func (mw *errorSanitizerMiddleware) PluginVersion() logical.PluginVersion {
+	return mw.next.PluginVersion()
+}
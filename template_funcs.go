@@ -0,0 +1,61 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/helper/template"
+)
+
+// shortHashLen is the length of the hex digest of short_hash
+const shortHashLen = 8
+
+// usernameTemplateFuncs returns the ClickHouse functions of the username
+// template, on top of the generic ones of Vault:
+//   - ch_safe strips the characters invalid in unquoted identifiers, e.g.
+//     {{ .RoleName | ch_safe }}
+//   - short_hash is the 8 first hex characters of the SHA256 of its input, e.g.
+//     {{ .DisplayName | short_hash }}
+//   - cluster is the cluster setting of the configuration
+//   - database is the database of the connection, from the database setting
+//     or the path of connection_url
+//
+// cluster and database read the configuration when the username is generated,
+// and are empty until it is initialized.
+func (c *Clickhouse) usernameTemplateFuncs() []template.Opt {
+	return []template.Opt{
+		template.Function("ch_safe", chSafe),
+		template.Function("short_hash", shortHash),
+		template.Function("cluster", func() string {
+			return c.Cluster
+		}),
+		template.Function("database", func() string {
+			return c.database
+		}),
+	}
+}
+
+// chSafe strips the characters of str invalid in unquoted ClickHouse
+// identifiers, and prefixes it with an underscore if it starts with a digit
+func chSafe(str string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return -1
+	}, str)
+	if safe != "" && safe[0] >= '0' && safe[0] <= '9' {
+		safe = "_" + safe
+	}
+
+	return safe
+}
+
+// shortHash returns the shortHashLen first hex characters of the SHA256 of str
+func shortHash(str string) string {
+	sum := sha256.Sum256([]byte(str))
+
+	return hex.EncodeToString(sum[:])[:shortHashLen]
+}
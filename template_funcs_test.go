@@ -0,0 +1,102 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	dbplugin "github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_chSafe(t *testing.T) {
+	tests := []struct {
+		name string
+		str  string
+		want string
+	}{
+		{
+			name: "Should keep valid identifiers",
+			str:  "v_token_Reader_01",
+			want: "v_token_Reader_01",
+		},
+		{
+			name: "Should strip invalid characters",
+			str:  "v-token.reader@corp 'x'",
+			want: "vtokenreadercorpx",
+		},
+		{
+			name: "Should strip non ASCII letters",
+			str:  "rôle",
+			want: "rle",
+		},
+		{
+			name: "Should prefix identifiers starting with a digit",
+			str:  "1-reader",
+			want: "_1reader",
+		},
+		{
+			name: "Should return an empty string",
+			str:  "-.-",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, chSafe(tt.str))
+		})
+	}
+}
+
+func Test_shortHash(t *testing.T) {
+	require.Equal(t, "2cf24dba", shortHash("hello"))
+	require.Len(t, shortHash(""), shortHashLen)
+	require.NotEqual(t, shortHash("reader"), shortHash("writer"))
+}
+
+func TestClickhouse_usernameTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           map[string]interface{}
+		usernameTemplate string
+		want             string
+	}{
+		{
+			name:             "Should generate safe usernames",
+			config:           map[string]interface{}{"connection_url": "tcp://127.0.0.1:1"},
+			usernameTemplate: `{{ printf "v_%s_%s" (.DisplayName | ch_safe) (.RoleName | short_hash) }}`,
+			want:             "v_tokenjohndoe_3d094196",
+		},
+		{
+			name:             "Should generate usernames with the cluster and database settings",
+			config:           map[string]interface{}{"connection_url": "tcp://127.0.0.1:1", "cluster": "main", "database": "analytics"},
+			usernameTemplate: `{{ printf "%s_%s_%s" cluster database .RoleName }}`,
+			want:             "main_analytics_reader",
+		},
+		{
+			name:             "Should generate usernames with the database of connection_url",
+			config:           map[string]interface{}{"connection_url": "tcp://127.0.0.1:1/events"},
+			usernameTemplate: `{{ printf "%s_%s" database .RoleName }}`,
+			want:             "events_reader",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newClickhouse(DefaultUserNameTemplate)
+			defer db.Close()
+			config := map[string]interface{}{"username_template": tt.usernameTemplate}
+			for k, v := range tt.config {
+				config[k] = v
+			}
+			// Nothing is sent to the server, so the unreachable host does not matter
+			_, err := db.Initialize(t.Context(), dbplugin.InitializeRequest{Config: config})
+			require.NoError(t, err)
+
+			username, _, _, err := db.newUserStatements(dbplugin.NewUserRequest{
+				UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "token-john.doe", RoleName: "reader"},
+				Statements:     dbplugin.Statements{Commands: []string{"CREATE USER '{{name}}'"}},
+				Password:       "09g8hanbdfkVSM",
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, username)
+		})
+	}
+}
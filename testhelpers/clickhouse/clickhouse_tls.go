@@ -4,116 +4,176 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
-	"path"
+	"path/filepath"
 	"time"
 )
 
-func cenCACertificates(savePath string) error {
+const containerCertsDir = "/etc/clickhouse-server/certs"
+
+// TLSMaterial holds the PEM encoded CA, server and client certificates and
+// keys of a test server, and the directory they are written to
+type TLSMaterial struct {
+	Dir string
+
+	CA                []byte
+	ServerCertificate []byte
+	ServerPrivateKey  []byte
+	ClientCertificate []byte
+	ClientPrivateKey  []byte
+}
+
+// GenerateTLSMaterial generates a CA, a server certificate valid for
+// localhost and a client certificate, both signed by the CA, and writes them
+// to dir, created if needed, as ca.crt, server.crt, server.key, client.crt
+// and client.key.
+func GenerateTLSMaterial(dir string) (*TLSMaterial, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
 	ca := &x509.Certificate{
 		SerialNumber: big.NewInt(2023),
 		Subject: pkix.Name{
 			Organization: []string{"Test."},
+			CommonName:   "Test CA",
 		},
-		NotBefore:             time.Now(),
+		NotBefore:             time.Now().Add(-time.Hour),
 		NotAfter:              time.Now().AddDate(10, 0, 0),
 		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
 	}
-
-	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	caPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
 	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
 	if err != nil {
-		return err
-	}
-	caPEM := new(bytes.Buffer)
-	err = pem.Encode(caPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	})
-	if err != nil {
-		return err
-	}
-
-	caPrivKeyPEM := new(bytes.Buffer)
-	err = pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caPrivKey),
-	})
-	if err != nil {
-		return err
-	}
-
-	// saveToDisk
-	cwd, _ := os.Getwd()
-	err = os.WriteFile(path.Join(cwd, savePath, "local_ca.crt"), caPEM.Bytes(), 0600)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(path.Join(cwd, savePath, "local_ca.key"), caPrivKeyPEM.Bytes(), 0600)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Generate a test certificate
-	cert := &x509.Certificate{
+	server := &x509.Certificate{
 		SerialNumber: big.NewInt(1658),
 		Subject: pkix.Name{
 			Organization: []string{"Test."},
 			CommonName:   "localhost",
 		},
-		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(10, 0, 0),
-		SubjectKeyId: []byte{1, 2, 3, 4, 6},
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:     x509.KeyUsageDigitalSignature,
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(10, 0, 0),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 	}
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return err
+	client := &x509.Certificate{
+		SerialNumber: big.NewInt(1659),
+		Subject: pkix.Name{
+			Organization: []string{"Test."},
+			CommonName:   "vault",
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(10, 0, 0),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 	}
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, ca, &certPrivKey.PublicKey, caPrivKey)
-	if err != nil {
-		return err
+
+	m := &TLSMaterial{Dir: dir, CA: encodePEM("CERTIFICATE", caBytes)}
+	if m.ServerCertificate, m.ServerPrivateKey, err = signCertificate(server, ca, caPrivKey); err != nil {
+		return nil, err
 	}
-	certPEM := new(bytes.Buffer)
-	err = pem.Encode(certPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certBytes,
-	})
-	if err != nil {
-		return err
+	if m.ClientCertificate, m.ClientPrivateKey, err = signCertificate(client, ca, caPrivKey); err != nil {
+		return nil, err
 	}
 
-	certPrivKeyPEM := new(bytes.Buffer)
-	err = pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
-	})
-	if err != nil {
-		return err
+	// The files are copied into the container with their owner, they must be
+	// readable by the clickhouse user
+	for name, content := range map[string][]byte{
+		"ca.crt":     m.CA,
+		"server.crt": m.ServerCertificate,
+		"server.key": m.ServerPrivateKey,
+		"client.crt": m.ClientCertificate,
+		"client.key": m.ClientPrivateKey,
+	} {
+		if err = os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil { //nolint:gosec
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// ClientTLSConfig returns a TLS configuration verifying the server against
+// the CA and, when withClientCertificate, presenting the client certificate
+func (m *TLSMaterial) ClientTLSConfig(withClientCertificate bool) (*tls.Config, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(m.CA) {
+		return nil, errors.New("invalid CA certificate")
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if withClientCertificate {
+		cert, err := tls.X509KeyPair(m.ClientCertificate, m.ClientPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
-	// saveToDisk
-	err = os.WriteFile(path.Join(savePath, "localnode.crt"), certPEM.Bytes(), 0600)
+
+	return config, nil
+}
+
+// renderTLSConfig renders the server configuration enabling the secure
+// native port with the certificates of containerCertsDir. When
+// requireClientCertificate, clients must present a certificate signed by the CA.
+func renderTLSConfig(requireClientCertificate bool) string {
+	verificationMode := "none"
+	if requireClientCertificate {
+		verificationMode = "strict"
+	}
+
+	return fmt.Sprintf(`<clickhouse>
+    <tcp_port_secure>9440</tcp_port_secure>
+    <openSSL replace="replace">
+        <server>
+            <certificateFile>%[1]s/server.crt</certificateFile>
+            <privateKeyFile>%[1]s/server.key</privateKeyFile>
+            <caConfig>%[1]s/ca.crt</caConfig>
+            <loadDefaultCAFile>false</loadDefaultCAFile>
+            <verificationMode>%[2]s</verificationMode>
+            <cacheSessions>true</cacheSessions>
+            <disableProtocols>sslv2,sslv3</disableProtocols>
+            <preferServerCiphers>true</preferServerCiphers>
+        </server>
+    </openSSL>
+</clickhouse>
+`, containerCertsDir, verificationMode)
+}
+
+// signCertificate generates a key for template and signs it with the CA,
+// returning the PEM encoded certificate and key
+func signCertificate(template, ca *x509.Certificate, caPrivKey *rsa.PrivateKey) ([]byte, []byte, error) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	err = os.WriteFile(path.Join(savePath, "localnode.key"), certPrivKeyPEM.Bytes(), 0600)
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, ca, &privKey.PublicKey, caPrivKey)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
+	return encodePEM("CERTIFICATE", certBytes), encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(privKey)), nil
+}
+
+func encodePEM(blockType string, b []byte) []byte {
+	buf := new(bytes.Buffer)
+	_ = pem.Encode(buf, &pem.Block{Type: blockType, Bytes: b})
+
+	return buf.Bytes()
 }
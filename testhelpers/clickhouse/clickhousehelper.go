@@ -2,11 +2,14 @@ package clickhousehelper
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/hashicorp/vault/sdk/helper/docker"
 )
 
@@ -17,20 +20,84 @@ type Config struct {
 
 var _ docker.ServiceConfig = &Config{}
 
-func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword string) (func(), string) {
+// TLSMode is the transport security of a test container
+type TLSMode int
+
+const (
+	// TLSDisabled serves the plain native port
+	TLSDisabled TLSMode = iota
+	// TLSEnabled serves the secure native port with a certificate signed by the test CA
+	TLSEnabled
+	// TLSMutual serves the secure native port and requires a client certificate signed by the test CA
+	TLSMutual
+)
+
+// ContainerOptions are the options of StartTestContainer
+type ContainerOptions struct {
+	AdminUser     string
+	AdminPassword string
+	TLS           TLSMode
+	// ImageVersion is the clickhouse/clickhouse-server image tag, ImageVersion() when empty
+	ImageVersion string
+}
+
+// TestContainer is a ClickHouse server started by StartTestContainer
+type TestContainer struct {
+	// URL is the admin connection URL, with secure=true when TLS is enabled.
+	// It doesn't skip the verification of the server certificate.
+	URL string
+	// TLS is the TLS material of the server, nil when TLS is disabled or
+	// the server is the one of CLICKHOUSE_URL
+	TLS *TLSMaterial
+}
+
+// PrepareTestContainer starts a ClickHouse server, or uses the one of
+// CLICKHOUSE_URL, and returns its admin connection URL. With useTLS the URL
+// skips the verification of the server certificate.
+func PrepareTestContainer(t testing.TB, useTLS bool, adminUser, adminPassword string) (func(), string) {
+	opts := ContainerOptions{AdminUser: adminUser, AdminPassword: adminPassword}
+	if useTLS {
+		opts.TLS = TLSEnabled
+	}
+	cleanup, container := StartTestContainer(t, opts)
+	if !useTLS || os.Getenv("CLICKHOUSE_URL") != "" {
+		return cleanup, container.URL
+	}
+	u, _ := url.Parse(container.URL)
+	q := u.Query()
+	q.Set("skip_verify", "true")
+	u.RawQuery = q.Encode()
+
+	return cleanup, u.String()
+}
+
+// StartTestContainer starts a ClickHouse server, or uses the one of
+// CLICKHOUSE_URL. With TLS, the certificates are generated in a temporary
+// directory and the server is only reachable on the secure port.
+func StartTestContainer(t testing.TB, opts ContainerOptions) (func(), *TestContainer) {
 	if os.Getenv("CLICKHOUSE_URL") != "" {
-		return func() {}, os.Getenv("CLICKHOUSE_URL")
+		return func() {}, &TestContainer{URL: os.Getenv("CLICKHOUSE_URL")}
 	}
 
-	imageVersion := "22.1.4.30-alpine"
+	imageVersion := opts.ImageVersion
+	if imageVersion == "" {
+		imageVersion = ImageVersion()
+	}
+	container := &TestContainer{}
 	extraCopy := map[string]string{}
 	ports := []string{"9000/tcp"}
-	if useTLS {
-		if err := cenCACertificates("testhelpers/resources/certs"); err != nil {
+	if opts.TLS != TLSDisabled {
+		var err error
+		dir := t.TempDir()
+		if container.TLS, err = GenerateTLSMaterial(filepath.Join(dir, "certs")); err != nil {
 			t.Fatalf("unable to generate SSL Certificates. err=%v", err.Error())
 		}
-		extraCopy["testhelpers/resources/certs"] = "/etc/clickhouse-server/certs"
-		extraCopy["testhelpers/resources/config.xml"] = "/etc/clickhouse-server/config.xml"
+		tlsConfig := filepath.Join(dir, "tls.xml")
+		if err = os.WriteFile(tlsConfig, []byte(renderTLSConfig(opts.TLS == TLSMutual)), 0o644); err != nil { //nolint:gosec
+			t.Fatalf("unable to write the TLS config. err=%v", err.Error())
+		}
+		extraCopy[container.TLS.Dir] = containerCertsDir
+		extraCopy[tlsConfig] = "/etc/clickhouse-server/config.d/tls.xml"
 		ports = []string{"9440/tcp"}
 	}
 	runner, err := docker.NewServiceRunner(docker.RunOptions{
@@ -38,8 +105,8 @@ func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword st
 		ImageTag:      imageVersion,
 		ContainerName: "clickhouse-server",
 		Env: []string{
-			"CLICKHOUSE_USER=" + adminUser,
-			"CLICKHOUSE_PASSWORD=" + adminPassword,
+			"CLICKHOUSE_USER=" + opts.AdminUser,
+			"CLICKHOUSE_PASSWORD=" + opts.AdminPassword,
 			"CLICKHOUSE_DEFAULT_ACCESS_MANAGEMENT=1",
 		},
 		CopyFromTo:      extraCopy,
@@ -53,11 +120,10 @@ func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword st
 	svc, err := runner.StartService(t.Context(), func(ctx context.Context, host string, port int) (docker.ServiceConfig, error) {
 		hostIP := docker.NewServiceHostPort(host, port)
 		q := make(url.Values)
-		q.Set("username", adminUser)
-		q.Set("password", adminPassword)
-		if useTLS {
+		q.Set("username", opts.AdminUser)
+		q.Set("password", opts.AdminPassword)
+		if opts.TLS != TLSDisabled {
 			q.Set("secure", "true")
-			q.Set("skip_verify", "true")
 		}
 		dsn := (&url.URL{
 			Scheme:   "tcp",
@@ -65,10 +131,16 @@ func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword st
 			RawQuery: q.Encode(),
 		}).String()
 
-		db, err := sql.Open("clickhouse", dsn)
+		options, err := clickhouse.ParseDSN(dsn)
 		if err != nil {
 			return nil, err
 		}
+		if container.TLS != nil {
+			if options.TLS, err = container.TLS.ClientTLSConfig(opts.TLS == TLSMutual); err != nil {
+				return nil, err
+			}
+		}
+		db := clickhouse.OpenDB(options)
 		defer db.Close()
 		err = db.Ping()
 		if err != nil {
@@ -80,8 +152,9 @@ func PrepareTestContainer(t *testing.T, useTLS bool, adminUser, adminPassword st
 	if err != nil {
 		t.Fatalf("could not start docker clickhouse: %s", err)
 	}
+	container.URL = svc.Config.(*Config).ConnString
 
-	return svc.Cleanup, svc.Config.(*Config).ConnString
+	return svc.Cleanup, container
 }
 
 func TestCredsExist(t testing.TB, connURL string) error {
@@ -93,3 +166,16 @@ func TestCredsExist(t testing.TB, connURL string) error {
 
 	return db.Ping()
 }
+
+// TestCredsExistTLS is TestCredsExist over a connection secured with tlsConfig
+func TestCredsExistTLS(t testing.TB, connURL string, tlsConfig *tls.Config) error {
+	options, err := clickhouse.ParseDSN(connURL)
+	if err != nil {
+		return err
+	}
+	options.TLS = tlsConfig
+	db := clickhouse.OpenDB(options)
+	defer db.Close()
+
+	return db.Ping()
+}
@@ -0,0 +1,270 @@
+package clickhousehelper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/helper/docker"
+)
+
+const (
+	keeperPort     = 9181
+	keeperRaftPort = 9234
+)
+
+// TestCluster is a ClickHouse cluster of replicas of a single shard,
+// coordinated by ClickHouse Keeper
+type TestCluster struct {
+	// Name is the cluster name of ON CLUSTER statements
+	Name string
+	// NodeURLs are the admin connection URLs of the nodes
+	NodeURLs []string
+}
+
+// UserURLs returns the connection URLs of the nodes with the given credentials
+func (c *TestCluster) UserURLs(username, password string) []string {
+	urls := make([]string, 0, len(c.NodeURLs))
+	for _, nodeURL := range c.NodeURLs {
+		u, _ := url.Parse(nodeURL)
+		q := u.Query()
+		q.Set("username", username)
+		q.Set("password", password)
+		u.RawQuery = q.Encode()
+		urls = append(urls, u.String())
+	}
+
+	return urls
+}
+
+// PrepareTestCluster starts a Keeper and nodes ClickHouse servers on a
+// dedicated Docker network. The servers are the replicas of the single shard
+// of the returned cluster, and store access entities both in a local
+// directory and, replicated through Keeper, in the replicated storage.
+//
+// CLICKHOUSE_CLUSTER and CLICKHOUSE_CLUSTER_URLS, a comma separated list of
+// admin connection URLs, select an existing cluster instead.
+func PrepareTestCluster(t testing.TB, nodes int, adminUser, adminPassword string) (func(), *TestCluster) {
+	if os.Getenv("CLICKHOUSE_CLUSTER_URLS") != "" {
+		return func() {}, &TestCluster{
+			Name:     os.Getenv("CLICKHOUSE_CLUSTER"),
+			NodeURLs: strings.Split(os.Getenv("CLICKHOUSE_CLUSTER_URLS"), ","),
+		}
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatalf("unable to generate the cluster id. err=%v", err.Error())
+	}
+	prefix := "clickhouse-" + id[:8]
+	cluster := &TestCluster{Name: "vault_test"}
+
+	dapi, err := docker.NewDockerAPI()
+	if err != nil {
+		t.Fatalf("could not connect to docker. err=%v", err.Error())
+	}
+	nw, err := dapi.NetworkCreate(t.Context(), prefix, network.CreateOptions{})
+	if err != nil {
+		t.Fatalf("could not create the docker network. err=%v", err.Error())
+	}
+	var cleanups []func()
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+		_ = dapi.NetworkRemove(context.Background(), nw.ID)
+	}
+
+	keeperHost := prefix + "-keeper"
+	nodeHosts := make([]string, nodes)
+	for i := range nodeHosts {
+		nodeHosts[i] = fmt.Sprintf("%s-node%d", prefix, i+1)
+	}
+	configDir := t.TempDir()
+
+	keeperConfig := filepath.Join(configDir, "keeper_config.xml")
+	if err = os.WriteFile(keeperConfig, []byte(renderKeeperConfig(keeperHost)), 0o600); err != nil {
+		cleanup()
+		t.Fatalf("unable to write the keeper config. err=%v", err.Error())
+	}
+	keeperCleanup, err := startKeeper(t.Context(), nw.ID, keeperHost, keeperConfig)
+	if err != nil {
+		cleanup()
+		t.Fatalf("could not start docker clickhouse keeper: %s", err)
+	}
+	cleanups = append(cleanups, keeperCleanup)
+
+	for i, host := range nodeHosts {
+		nodeConfig := filepath.Join(configDir, host+".xml")
+		if err = os.WriteFile(nodeConfig, []byte(renderNodeConfig(cluster.Name, host, keeperHost, nodeHosts)), 0o600); err != nil {
+			cleanup()
+			t.Fatalf("unable to write the node config. err=%v", err.Error())
+		}
+		nodeCleanup, dsn, err := startNode(t.Context(), nw.ID, host, nodeConfig, adminUser, adminPassword)
+		if err != nil {
+			cleanup()
+			t.Fatalf("could not start docker clickhouse node %d: %s", i+1, err)
+		}
+		cleanups = append(cleanups, nodeCleanup)
+		cluster.NodeURLs = append(cluster.NodeURLs, dsn)
+	}
+
+	return cleanup, cluster
+}
+
+func startKeeper(ctx context.Context, networkID, host, config string) (func(), error) {
+	runner, err := docker.NewServiceRunner(docker.RunOptions{
+		ImageRepo:     "clickhouse/clickhouse-server",
+		ImageTag:      ImageVersion(),
+		ContainerName: host,
+		NetworkID:     networkID,
+		Entrypoint:    []string{"clickhouse", "keeper", "--config-file", "/etc/clickhouse-keeper/keeper_config.xml"},
+		CopyFromTo:    map[string]string{config: "/etc/clickhouse-keeper/keeper_config.xml"},
+		Ports:         []string{strconv.Itoa(keeperPort) + "/tcp"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	svc, _, err := runner.StartNewService(ctx, false, true, func(ctx context.Context, host string, port int) (docker.ServiceConfig, error) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		return docker.NewServiceHostPort(host, port), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return svc.Cleanup, nil
+}
+
+func startNode(ctx context.Context, networkID, host, config, adminUser, adminPassword string) (func(), string, error) {
+	runner, err := docker.NewServiceRunner(docker.RunOptions{
+		ImageRepo:     "clickhouse/clickhouse-server",
+		ImageTag:      ImageVersion(),
+		ContainerName: host,
+		NetworkID:     networkID,
+		Env: []string{
+			"CLICKHOUSE_USER=" + adminUser,
+			"CLICKHOUSE_PASSWORD=" + adminPassword,
+			"CLICKHOUSE_DEFAULT_ACCESS_MANAGEMENT=1",
+		},
+		CopyFromTo: map[string]string{config: "/etc/clickhouse-server/config.d/cluster.xml"},
+		Ports:      []string{"9000/tcp"},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	svc, _, err := runner.StartNewService(ctx, false, true, func(ctx context.Context, host string, port int) (docker.ServiceConfig, error) {
+		hostIP := docker.NewServiceHostPort(host, port)
+		q := make(url.Values)
+		q.Set("username", adminUser)
+		q.Set("password", adminPassword)
+		dsn := (&url.URL{
+			Scheme:   "tcp",
+			Host:     hostIP.Address(),
+			RawQuery: q.Encode(),
+		}).String()
+
+		db, err := sql.Open("clickhouse", dsn)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		// The node is ready once it reaches Keeper
+		if _, err = db.ExecContext(ctx, "SELECT * FROM system.zookeeper WHERE path = '/'"); err != nil {
+			return nil, err
+		}
+
+		return &Config{ServiceHostPort: *hostIP, ConnString: dsn}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return svc.Cleanup, svc.Config.(*Config).ConnString, nil
+}
+
+func renderKeeperConfig(host string) string {
+	return fmt.Sprintf(`<clickhouse>
+    <listen_host>0.0.0.0</listen_host>
+    <logger>
+        <level>information</level>
+        <console>1</console>
+    </logger>
+    <keeper_server>
+        <tcp_port>%d</tcp_port>
+        <server_id>1</server_id>
+        <log_storage_path>/var/lib/clickhouse/coordination/log</log_storage_path>
+        <snapshot_storage_path>/var/lib/clickhouse/coordination/snapshots</snapshot_storage_path>
+        <raft_configuration>
+            <server>
+                <id>1</id>
+                <hostname>%s</hostname>
+                <port>%d</port>
+            </server>
+        </raft_configuration>
+    </keeper_server>
+</clickhouse>
+`, keeperPort, host, keeperRaftPort)
+}
+
+func renderNodeConfig(cluster, host, keeperHost string, nodeHosts []string) string {
+	var replicas strings.Builder
+	for _, nodeHost := range nodeHosts {
+		fmt.Fprintf(&replicas, `
+                <replica>
+                    <host>%s</host>
+                    <port>9000</port>
+                </replica>`, nodeHost)
+	}
+
+	return fmt.Sprintf(`<clickhouse>
+    <zookeeper>
+        <node>
+            <host>%[1]s</host>
+            <port>%[2]d</port>
+        </node>
+    </zookeeper>
+    <remote_servers replace="replace">
+        <%[3]s>
+            <shard>
+                <internal_replication>true</internal_replication>%[4]s
+            </shard>
+        </%[3]s>
+    </remote_servers>
+    <macros>
+        <cluster>%[3]s</cluster>
+        <shard>1</shard>
+        <replica>%[5]s</replica>
+    </macros>
+    <distributed_ddl>
+        <path>/clickhouse/task_queue/ddl</path>
+    </distributed_ddl>
+    <user_directories replace="replace">
+        <users_xml>
+            <path>users.xml</path>
+        </users_xml>
+        <local_directory>
+            <path>/var/lib/clickhouse/access/</path>
+        </local_directory>
+        <replicated>
+            <zookeeper_path>/clickhouse/access/</zookeeper_path>
+        </replicated>
+    </user_directories>
+</clickhouse>
+`, keeperHost, keeperPort, cluster, replicas.String(), host)
+}
@@ -0,0 +1,591 @@
+package clickhousehelper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ClickHouse/ch-go/proto"
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// fakeServerRevision is the native protocol revision of the fake server. It
+// predates the addendum and custom serialization, which keeps the server simple.
+const fakeServerRevision = 54451
+
+// ClickHouse exception codes raised by the fake server
+const (
+	codeUnknownUser               int32 = 192
+	codeAccessEntityAlreadyExists int32 = 493
+	codeAuthenticationFailed      int32 = 516
+)
+
+var (
+	createUserRegexp  = regexp.MustCompile(`(?is)^CREATE\s+USER\s+(IF\s+NOT\s+EXISTS\s+|OR\s+REPLACE\s+)?'([^']+)'(.*)$`)
+	alterUserRegexp   = regexp.MustCompile(`(?is)^ALTER\s+USER\s+(IF\s+EXISTS\s+)?'([^']+)'(.*)$`)
+	dropUserRegexp    = regexp.MustCompile(`(?is)^DROP\s+USER\s+(IF\s+EXISTS\s+)?'([^']+)'`)
+	identifiedRegexp  = regexp.MustCompile(`(?is)\bIDENTIFIED\s+(?:WITH\s+\w+\s+)?BY\s+'((?:[^'\\]|\\.)*)'`)
+	currentUserRegexp = regexp.MustCompile(`(?i)^SELECT\s+currentUser\(\)`)
+	selectRegexp      = regexp.MustCompile(`(?i)^(SELECT|SHOW|WITH)\s`)
+	systemUsersRegexp = regexp.MustCompile(`(?is)^SELECT\s+name\s+FROM\s+system\.users(?:\s+WHERE\s+name\s+(=|LIKE)\s+'([^']*)')?`)
+)
+
+// FakeQuery is a query received by the fake server
+type FakeQuery struct {
+	Body     string
+	User     string
+	Settings map[string]string
+}
+
+// FakeColumn is a column of the result of a query. Values are strings for
+// the String type, and uint64 for UInt64.
+type FakeColumn struct {
+	Name   string
+	Type   string
+	Values []interface{}
+}
+
+// FakeResult is the result of a SELECT query
+type FakeResult struct {
+	Columns []FakeColumn
+}
+
+// QueryHandler answers the queries matched by the pattern it is registered
+// with. Returning a *clickhouse.Exception makes the server raise it.
+type QueryHandler func(query string) (*FakeResult, error)
+
+type fakeHandler struct {
+	pattern *regexp.Regexp
+	handler QueryHandler
+}
+
+type fakeFailure struct {
+	match     string
+	exception *clickhouse.Exception
+	// times is the number of queries left to fail, negative for all of them
+	times int
+}
+
+// FakeServer is an in-process server speaking the ClickHouse native
+// protocol. It records the queries it receives, emulates CREATE/ALTER/DROP
+// USER and system.users, answers the queries the plugin sends when it
+// verifies its connection, and accepts any other statement.
+type FakeServer struct {
+	listener      net.Listener
+	adminUser     string
+	adminPassword string
+
+	mu       sync.Mutex
+	version  string
+	users    map[string]string
+	queries  []FakeQuery
+	handlers []fakeHandler
+	failures []*fakeFailure
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// StartFakeServer starts a fake server accepting adminUser and adminPassword,
+// it is stopped at the end of the test.
+func StartFakeServer(t testing.TB, adminUser, adminPassword string) *FakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start the fake clickhouse server. err=%v", err.Error())
+	}
+	s := &FakeServer{
+		listener:      listener,
+		adminUser:     adminUser,
+		adminPassword: adminPassword,
+		version:       "24.3.1.2672",
+		users:         map[string]string{},
+		conns:         map[net.Conn]struct{}{},
+	}
+	s.registerDefaultHandlers()
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// URL returns the connection URL of the admin user
+func (s *FakeServer) URL() string {
+	return s.UserURL(s.adminUser, s.adminPassword)
+}
+
+// UserURL returns the connection URL of the given credentials
+func (s *FakeServer) UserURL(username, password string) string {
+	q := make(url.Values)
+	q.Set("username", username)
+	q.Set("password", password)
+
+	return (&url.URL{
+		Scheme:   "tcp",
+		Host:     s.listener.Addr().String(),
+		RawQuery: q.Encode(),
+	}).String()
+}
+
+// Close stops the server and closes its connections
+func (s *FakeServer) Close() {
+	_ = s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// SetVersion sets the version returned by SELECT version()
+func (s *FakeServer) SetVersion(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+}
+
+// Handle makes handler answer the queries matching pattern, before the
+// default handlers
+func (s *FakeServer) Handle(pattern string, handler QueryHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = slices.Insert(s.handlers, 0, fakeHandler{pattern: regexp.MustCompile(pattern), handler: handler})
+}
+
+// Fail makes the next times queries containing match, case insensitively,
+// fail with the given exception. A negative times fails all of them.
+func (s *FakeServer) Fail(match string, code int32, message string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &fakeFailure{
+		match:     strings.ToUpper(match),
+		exception: &clickhouse.Exception{Code: code, Name: "DB::Exception", Message: message},
+		times:     times,
+	})
+}
+
+// Queries returns the queries received so far
+func (s *FakeServer) Queries() []FakeQuery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.queries)
+}
+
+// Statements returns the bodies of the queries received so far
+func (s *FakeServer) Statements() []string {
+	var statements []string
+	for _, q := range s.Queries() {
+		statements = append(statements, q.Body)
+	}
+
+	return statements
+}
+
+// Users returns the users created on the server, with their password
+func (s *FakeServer) Users() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.users)
+}
+
+// AddUser creates a user, as if it had been created by a statement
+func (s *FakeServer) AddUser(name, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[name] = password
+}
+
+func (s *FakeServer) registerDefaultHandlers() {
+	s.handlers = []fakeHandler{
+		{pattern: regexp.MustCompile(`(?i)^SELECT\s+version\(\)`), handler: func(string) (*FakeResult, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			return stringResult("version()", s.version), nil
+		}},
+		{pattern: regexp.MustCompile(`(?i)^SELECT\s+name,\s*type\s+FROM\s+system\.user_directories`), handler: func(string) (*FakeResult, error) {
+			return &FakeResult{Columns: []FakeColumn{
+				{Name: "name", Type: "String", Values: []interface{}{"users_xml", "local_directory"}},
+				{Name: "type", Type: "String", Values: []interface{}{"users_xml", "local_directory"}},
+			}}, nil
+		}},
+		{pattern: regexp.MustCompile(`(?i)^SELECT\s+access_type\s+FROM\s+system\.grants`), handler: func(string) (*FakeResult, error) {
+			return stringResult("access_type", "ALL"), nil
+		}},
+		{pattern: regexp.MustCompile(`(?i)^SELECT\s+granted_role_name\s+FROM\s+system\.role_grants`), handler: func(string) (*FakeResult, error) {
+			return stringResult("granted_role_name"), nil
+		}},
+		{pattern: regexp.MustCompile(`(?i)^SELECT\s+count\(\)\s+FROM\s+system\.clusters`), handler: func(string) (*FakeResult, error) {
+			return &FakeResult{Columns: []FakeColumn{{Name: "count()", Type: "UInt64", Values: []interface{}{uint64(1)}}}}, nil
+		}},
+		{pattern: systemUsersRegexp, handler: s.systemUsers},
+	}
+}
+
+func (s *FakeServer) systemUsers(query string) (*FakeResult, error) {
+	match := systemUsersRegexp.FindStringSubmatch(query)
+	var filter *regexp.Regexp
+	switch match[1] {
+	case "=":
+		filter = regexp.MustCompile("^" + regexp.QuoteMeta(match[2]) + "$")
+	case "LIKE", "like":
+		pattern := regexp.QuoteMeta(match[2])
+		pattern = strings.NewReplacer("%", ".*", "_", ".").Replace(pattern)
+		filter = regexp.MustCompile("^" + pattern + "$")
+	}
+	var names []string
+	for name := range s.Users() {
+		if filter == nil || filter.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return stringResult("name", names...), nil
+}
+
+func stringResult(name string, values ...string) *FakeResult {
+	column := FakeColumn{Name: name, Type: "String"}
+	for _, v := range values {
+		column.Values = append(column.Values, v)
+	}
+
+	return &FakeResult{Columns: []FakeColumn{column}}
+}
+
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			_ = s.handleConn(conn)
+			_ = conn.Close()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// fakeConn is a client connection of the fake server
+type fakeConn struct {
+	conn     net.Conn
+	reader   *proto.Reader
+	buf      *proto.Buffer
+	revision int
+	user     string
+}
+
+func (c *fakeConn) flush() error {
+	_, err := c.conn.Write(c.buf.Buf)
+	c.buf.Reset()
+
+	return err
+}
+
+func (c *fakeConn) exception(e *clickhouse.Exception) error {
+	proto.ServerCodeException.Encode(c.buf)
+	(&proto.Exception{Code: proto.Error(e.Code), Name: e.Name, Message: e.Message}).EncodeAware(c.buf, c.revision)
+
+	return c.flush()
+}
+
+func (s *FakeServer) handleConn(conn net.Conn) error {
+	c := &fakeConn{
+		conn:   conn,
+		reader: proto.NewReader(bufio.NewReader(conn)),
+		buf:    new(proto.Buffer),
+	}
+	if err := s.handshake(c); err != nil {
+		return err
+	}
+	for {
+		code, err := c.reader.UVarInt()
+		if err != nil {
+			return err
+		}
+		switch proto.ClientCode(code) {
+		case proto.ClientCodePing:
+			proto.ServerCodePong.Encode(c.buf)
+			if err = c.flush(); err != nil {
+				return err
+			}
+		case proto.ClientCodeQuery:
+			if err = s.handleQuery(c); err != nil {
+				return err
+			}
+		case proto.ClientCodeCancel:
+			return io.EOF
+		default:
+			return fmt.Errorf("unexpected packet %d", code)
+		}
+	}
+}
+
+func (s *FakeServer) handshake(c *fakeConn) error {
+	code, err := c.reader.UVarInt()
+	if err != nil {
+		return err
+	}
+	if proto.ClientCode(code) != proto.ClientCodeHello {
+		return fmt.Errorf("unexpected packet %d", code)
+	}
+	var hello proto.ClientHello
+	if err = hello.Decode(c.reader); err != nil {
+		return err
+	}
+	c.revision = min(hello.ProtocolVersion, fakeServerRevision)
+	c.user = hello.User
+
+	if !s.authenticate(hello.User, hello.Password) {
+		return errors.Join(c.exception(&clickhouse.Exception{
+			Code:    codeAuthenticationFailed,
+			Name:    "DB::Exception",
+			Message: hello.User + ": Authentication failed: password is incorrect, or there is no user with such name.",
+		}), io.EOF)
+	}
+
+	s.mu.Lock()
+	version := s.version
+	s.mu.Unlock()
+	var major, minor int
+	_, _ = fmt.Sscanf(version, "%d.%d", &major, &minor)
+	info := proto.ServerHello{
+		Name:        "ClickHouse",
+		Major:       major,
+		Minor:       minor,
+		Revision:    fakeServerRevision,
+		Timezone:    "UTC",
+		DisplayName: "fake",
+	}
+	info.EncodeAware(c.buf, c.revision)
+
+	return c.flush()
+}
+
+func (s *FakeServer) authenticate(user, password string) bool {
+	if user == s.adminUser {
+		return password == s.adminPassword
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	userPassword, ok := s.users[user]
+
+	return ok && userPassword == password
+}
+
+func (s *FakeServer) handleQuery(c *fakeConn) error {
+	var q proto.Query
+	if err := q.DecodeAware(c.reader, c.revision); err != nil {
+		return err
+	}
+	if q.Compression == proto.CompressionEnabled {
+		return errors.New("compression is not supported by the fake server")
+	}
+	// The query is followed by an empty data block, external tables aside
+	code, err := c.reader.UVarInt()
+	if err != nil {
+		return err
+	}
+	if proto.ClientCode(code) != proto.ClientCodeData {
+		return fmt.Errorf("unexpected packet %d", code)
+	}
+	var data proto.ClientData
+	if err = data.DecodeAware(c.reader, c.revision); err != nil {
+		return err
+	}
+	var block proto.Block
+	if err = block.DecodeBlock(c.reader, c.revision, nil); err != nil {
+		return err
+	}
+
+	settings := make(map[string]string, len(q.Settings))
+	for _, setting := range q.Settings {
+		settings[setting.Key] = setting.Value
+	}
+	body := strings.TrimSpace(q.Body)
+	s.mu.Lock()
+	s.queries = append(s.queries, FakeQuery{Body: body, User: c.user, Settings: settings})
+	s.mu.Unlock()
+
+	result, err := s.execute(body, c.user)
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return c.exception(exception)
+	}
+	if err != nil {
+		return c.exception(&clickhouse.Exception{Code: 1001, Name: "std::exception", Message: err.Error()})
+	}
+	if result != nil {
+		if err = encodeResult(c, result); err != nil {
+			return err
+		}
+	}
+	proto.ServerCodeEndOfStream.Encode(c.buf)
+
+	return c.flush()
+}
+
+// execute runs query of user against the emulated server, returning its
+// result if any
+func (s *FakeServer) execute(query string, user string) (*FakeResult, error) {
+	s.mu.Lock()
+	for _, failure := range s.failures {
+		if failure.times != 0 && strings.Contains(strings.ToUpper(query), failure.match) {
+			failure.times--
+			s.mu.Unlock()
+
+			return nil, failure.exception
+		}
+	}
+	handlers := slices.Clone(s.handlers)
+	s.mu.Unlock()
+
+	for _, h := range handlers {
+		if h.pattern.MatchString(query) {
+			return h.handler(query)
+		}
+	}
+
+	switch {
+	case currentUserRegexp.MatchString(query):
+		return stringResult("currentUser()", user), nil
+	case createUserRegexp.MatchString(query):
+		return nil, s.createUser(createUserRegexp.FindStringSubmatch(query))
+	case alterUserRegexp.MatchString(query):
+		return nil, s.alterUser(alterUserRegexp.FindStringSubmatch(query))
+	case dropUserRegexp.MatchString(query):
+		return nil, s.dropUser(dropUserRegexp.FindStringSubmatch(query))
+	case selectRegexp.MatchString(query):
+		return nil, fmt.Errorf("the fake server cannot answer %q, register a handler", query)
+	}
+
+	return nil, nil
+}
+
+func (s *FakeServer) createUser(match []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	modifier, name := strings.ToUpper(strings.Join(strings.Fields(match[1]), " ")), match[2]
+	if _, ok := s.users[name]; ok {
+		switch modifier {
+		case "IF NOT EXISTS":
+			return nil
+		case "OR REPLACE":
+		default:
+			return &clickhouse.Exception{
+				Code:    codeAccessEntityAlreadyExists,
+				Name:    "DB::Exception",
+				Message: fmt.Sprintf("user `%s`: cannot insert because user `%s` already exists in local directory", name, name),
+			}
+		}
+	}
+	s.users[name] = passwordOf(match[3])
+
+	return nil
+}
+
+func (s *FakeServer) alterUser(match []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := match[2]
+	if _, ok := s.users[name]; !ok {
+		if match[1] != "" {
+			return nil
+		}
+
+		return unknownUser(name)
+	}
+	if identifiedRegexp.MatchString(match[3]) {
+		s.users[name] = passwordOf(match[3])
+	}
+
+	return nil
+}
+
+func (s *FakeServer) dropUser(match []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := match[2]
+	if _, ok := s.users[name]; !ok && match[1] == "" {
+		return unknownUser(name)
+	}
+	delete(s.users, name)
+
+	return nil
+}
+
+func unknownUser(name string) error {
+	return &clickhouse.Exception{
+		Code:    codeUnknownUser,
+		Name:    "DB::Exception",
+		Message: fmt.Sprintf("There is no user `%s` in user directories", name),
+	}
+}
+
+// passwordOf returns the password of the IDENTIFIED BY clause of a statement
+func passwordOf(statement string) string {
+	match := identifiedRegexp.FindStringSubmatch(statement)
+	if match == nil {
+		return ""
+	}
+
+	return strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(match[1])
+}
+
+func encodeResult(c *fakeConn, result *FakeResult) error {
+	var input proto.Input
+	rows := 0
+	for _, column := range result.Columns {
+		var data proto.ColInput
+		switch column.Type {
+		case "String":
+			col := new(proto.ColStr)
+			for _, v := range column.Values {
+				col.Append(fmt.Sprint(v))
+			}
+			data = col
+		case "UInt64":
+			col := new(proto.ColUInt64)
+			for _, v := range column.Values {
+				n, ok := v.(uint64)
+				if !ok {
+					return fmt.Errorf("column %s: %v is not an uint64", column.Name, v)
+				}
+				col.Append(n)
+			}
+			data = col
+		default:
+			return fmt.Errorf("column %s: unsupported type %s", column.Name, column.Type)
+		}
+		rows = len(column.Values)
+		input = append(input, proto.InputColumn{Name: column.Name, Data: data})
+	}
+
+	proto.ServerCodeData.Encode(c.buf)
+	c.buf.PutString("") // temporary table name
+	block := proto.Block{Info: proto.BlockInfo{BucketNum: -1}, Columns: len(input), Rows: rows}
+
+	return block.EncodeBlock(c.buf, c.revision, input)
+}
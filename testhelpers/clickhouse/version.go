@@ -0,0 +1,96 @@
+package clickhousehelper
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// defaultImageVersion is the clickhouse/clickhouse-server image tag of test
+// servers when CLICKHOUSE_VERSION is not set
+const defaultImageVersion = "22.1.4.30-alpine"
+
+// ImageVersion returns the clickhouse/clickhouse-server image tag of test
+// servers: CLICKHOUSE_VERSION, e.g. 24.8-alpine, or the default one
+func ImageVersion() string {
+	if v := os.Getenv("CLICKHOUSE_VERSION"); v != "" {
+		return v
+	}
+
+	return defaultImageVersion
+}
+
+// ServerVersion returns the version() of the server of connURL
+func ServerVersion(ctx context.Context, connURL string) (string, error) {
+	db, err := sql.Open("clickhouse", connURL)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var version string
+	err = db.QueryRowContext(ctx, "SELECT version()").Scan(&version)
+
+	return version, err
+}
+
+// RequireVersion skips t unless the server of connURL runs minVersion, e.g.
+// 23.9, or later. Tests of statements only newer servers support are gated
+// with it, so that the suite runs against every supported version.
+func RequireVersion(t testing.TB, connURL, minVersion string) {
+	t.Helper()
+	version, err := ServerVersion(t.Context(), connURL)
+	if err != nil {
+		t.Fatalf("unable to get the server version. err=%v", err.Error())
+	}
+	atLeast, err := versionAtLeast(version, minVersion)
+	if err != nil {
+		t.Fatalf("unable to compare the server version. err=%v", err.Error())
+	}
+	if !atLeast {
+		t.Skipf("requires ClickHouse %s or later, the server runs %s", minVersion, version)
+	}
+}
+
+// versionAtLeast reports whether version is minVersion or later, comparing
+// the components of minVersion only
+func versionAtLeast(version, minVersion string) (bool, error) {
+	got, err := versionComponents(version)
+	if err != nil {
+		return false, err
+	}
+	want, err := versionComponents(minVersion)
+	if err != nil {
+		return false, err
+	}
+	for i, w := range want {
+		g := 0
+		if i < len(got) {
+			g = got[i]
+		}
+		if g != w {
+			return g > w, nil
+		}
+	}
+
+	return true, nil
+}
+
+func versionComponents(version string) ([]int, error) {
+	version, _, _ = strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	components := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		components = append(components, n)
+	}
+
+	return components, nil
+}
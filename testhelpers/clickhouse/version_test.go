@@ -0,0 +1,38 @@
+package clickhousehelper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_versionAtLeast(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    string
+		minVersion string
+		want       bool
+		wantErr    bool
+	}{
+		{name: "Should accept the same version", version: "23.9.1.1854", minVersion: "23.9", want: true},
+		{name: "Should accept a later minor version", version: "23.10.1.1", minVersion: "23.9", want: true},
+		{name: "Should accept a later major version", version: "24.3.1.2672", minVersion: "23.9", want: true},
+		{name: "Should reject an earlier minor version", version: "23.8.2.7", minVersion: "23.9", want: false},
+		{name: "Should reject an earlier major version", version: "22.1.4.30", minVersion: "23.5", want: false},
+		{name: "Should compare patch versions", version: "23.8.2.7", minVersion: "23.8.3", want: false},
+		{name: "Should ignore image tag suffixes", version: "24.8-alpine", minVersion: "24.8", want: true},
+		{name: "Should return an error for an invalid version", version: "head", minVersion: "23.9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := versionAtLeast(tt.version, tt.minVersion)
+			if tt.wantErr {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
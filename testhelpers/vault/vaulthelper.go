@@ -0,0 +1,194 @@
+package vaulthelper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rootToken = "root"
+
+// DevServer is a Vault server started in dev mode, unsealed and logged in
+// with a root token, serving the plugins of its plugin directory
+type DevServer struct {
+	// Addr is the address of the HTTP API, e.g. http://127.0.0.1:8200
+	Addr string
+	// PluginDir is the plugin directory of the server
+	PluginDir string
+
+	client *http.Client
+	logs   *syncBuffer
+}
+
+// Response is the JSON body of a Vault API response
+type Response struct {
+	Data          map[string]interface{} `json:"data"`
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Errors        []string               `json:"errors"`
+}
+
+// APIError is a Vault API response with an error status code
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Errors     []string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: %d: %s", e.Method, e.Path, e.StatusCode, strings.Join(e.Errors, ", "))
+}
+
+// StartDevServer runs `vault server -dev` with a temporary plugin directory,
+// skipping t when the vault binary is not in PATH. The server is stopped,
+// and its logs written to the test output on failure, when t completes.
+func StartDevServer(t testing.TB) *DevServer {
+	t.Helper()
+	vaultBin, err := exec.LookPath("vault")
+	if err != nil {
+		t.Skip("vault is not in PATH")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to find a free port. err=%v", err.Error())
+	}
+	listenAddr := listener.Addr().String()
+	listener.Close() //nolint:gosec
+
+	s := &DevServer{
+		Addr:      "http://" + listenAddr,
+		PluginDir: t.TempDir(),
+		client:    &http.Client{Timeout: time.Minute},
+		logs:      &syncBuffer{},
+	}
+	cmd := exec.Command(vaultBin, "server", "-dev", //nolint:gosec
+		"-dev-root-token-id="+rootToken,
+		"-dev-listen-address="+listenAddr,
+		"-dev-plugin-dir="+s.PluginDir,
+	)
+	cmd.Env = append(os.Environ(), "VAULT_ADDR="+s.Addr)
+	cmd.Stdout = s.logs
+	cmd.Stderr = s.logs
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("unable to start vault. err=%v", err.Error())
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if t.Failed() {
+			t.Logf("vault logs:\n%s", s.logs.String())
+		}
+	})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		_, err = s.Request(t.Context(), http.MethodGet, "sys/health", nil)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("vault is not ready. err=%v\n%s", err.Error(), s.logs.String())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	return s
+}
+
+// RegisterPlugin builds the main package pkg into the plugin directory and
+// registers it as the database plugin name
+func (s *DevServer) RegisterPlugin(t testing.TB, pkg, name string) {
+	t.Helper()
+	binary := filepath.Join(s.PluginDir, name)
+	build := exec.CommandContext(t.Context(), "go", "build", "-o", binary, pkg) //nolint:gosec
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("unable to build the plugin. err=%v\n%s", err.Error(), out)
+	}
+
+	content, err := os.ReadFile(binary)
+	if err != nil {
+		t.Fatalf("unable to read the plugin. err=%v", err.Error())
+	}
+	sum := sha256.Sum256(content)
+	_, err = s.Request(t.Context(), http.MethodPut, "sys/plugins/catalog/database/"+name, map[string]interface{}{
+		"sha256":  hex.EncodeToString(sum[:]),
+		"command": name,
+	})
+	if err != nil {
+		t.Fatalf("unable to register the plugin. err=%v", err.Error())
+	}
+}
+
+// Request sends a request to the API path, relative to /v1/, with the root
+// token and the JSON encoded body if any. API errors are *APIError.
+func (s *DevServer) Request(ctx context.Context, method, path string, body map[string]interface{}) (*Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.Addr+"/v1/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", rootToken)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &Response{}
+	if b, err := io.ReadAll(resp.Body); err != nil {
+		return nil, err
+	} else if len(b) > 0 {
+		if err = json.Unmarshal(b, result); err != nil {
+			return nil, fmt.Errorf("%s %s: %d: invalid response: %w", method, path, resp.StatusCode, err)
+		}
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Errors: result.Errors}
+	}
+
+	return result, nil
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of the
+// server output and reads of the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
@@ -0,0 +1,42 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// buildTLSConfig returns the TLS configuration verifying the server against
+// the PEM encoded caPEM, in place of the system roots, and presenting the
+// PEM encoded client certificate and key if any. It returns nil when none is
+// set, leaving TLS to the connection string.
+func buildTLSConfig(caPEM, certPEM, keyPEM string, skipVerify bool) (*tls.Config, error) {
+	if caPEM == "" && certPEM == "" && keyPEM == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipVerify, //nolint:gosec
+	}
+	if caPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, errors.New("invalid tls_ca: no PEM encoded certificate found")
+		}
+		config.RootCAs = pool
+	}
+	if (certPEM == "") != (keyPEM == "") {
+		return nil, errors.New("tls_certificate and tls_private_key must be set together")
+	}
+	if certPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_certificate or tls_private_key: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,85 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	clickhousehelper "github.com/contentsquare/vault-plugin-database-clickhouse/testhelpers/clickhouse"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildTLSConfig(t *testing.T) {
+	material, err := clickhousehelper.GenerateTLSMaterial(t.TempDir())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		ca              string
+		cert            string
+		key             string
+		skipVerify      bool
+		wantNil         bool
+		wantRootCAs     bool
+		wantCertificate bool
+		wantErr         string
+	}{
+		{
+			name:    "Should leave TLS to the connection string without material",
+			wantNil: true,
+		},
+		{
+			name:        "Should verify the server against the CA",
+			ca:          string(material.CA),
+			wantRootCAs: true,
+		},
+		{
+			name:            "Should present the client certificate",
+			ca:              string(material.CA),
+			cert:            string(material.ClientCertificate),
+			key:             string(material.ClientPrivateKey),
+			wantRootCAs:     true,
+			wantCertificate: true,
+		},
+		{
+			name:            "Should present the client certificate without a CA",
+			cert:            string(material.ClientCertificate),
+			key:             string(material.ClientPrivateKey),
+			skipVerify:      true,
+			wantCertificate: true,
+		},
+		{
+			name:    "Should return an error for an invalid CA",
+			ca:      "not a certificate",
+			wantErr: "invalid tls_ca",
+		},
+		{
+			name:    "Should return an error for a certificate without a key",
+			cert:    string(material.ClientCertificate),
+			wantErr: "must be set together",
+		},
+		{
+			name:    "Should return an error for a key not matching the certificate",
+			cert:    string(material.ClientCertificate),
+			key:     string(material.ServerPrivateKey),
+			wantErr: "invalid tls_certificate or tls_private_key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildTLSConfig(tt.ca, tt.cert, tt.key, tt.skipVerify)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantNil {
+				require.Nil(t, got)
+
+				return
+			}
+			require.Equal(t, tt.wantRootCAs, got.RootCAs != nil)
+			require.Equal(t, tt.wantCertificate, len(got.Certificates) == 1)
+			require.Equal(t, tt.skipVerify, got.InsecureSkipVerify)
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/contentsquare/vault-plugin-database-clickhouse"
+
+// Span attributes
+const (
+	attrOperation      = attribute.Key("vault.operation")
+	attrRole           = attribute.Key("vault.role")
+	attrStatementIndex = attribute.Key("db.clickhouse.statement.index")
+	attrCluster        = attribute.Key("db.clickhouse.cluster")
+	attrExceptionCode  = attribute.Key("db.clickhouse.exception.code")
+	attrServerAddress  = attribute.Key("server.address")
+)
+
+var onClusterRegexp = regexp.MustCompile("(?i)\\bON\\s+CLUSTER\\s+['\"`]?([^'\"`\\s;]+)")
+
+// startOperationSpan starts the span of a dbplugin RPC. Spans are not
+// recorded unless a tracer provider has been registered with otel.
+func startOperationSpan(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attrOperation.String(operation))
+
+	return otel.Tracer(tracerName).Start(ctx, "clickhouse."+operation,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// startStatementSpan starts the span of a single statement
+func startStatementSpan(ctx context.Context, operation string, index int, query string, addr string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attrOperation.String(operation),
+		attrStatementIndex.Int(index),
+		attrServerAddress.String(addr),
+		attribute.String("db.system", "clickhouse"),
+	}
+	if cluster := clusterOf(query); cluster != "" {
+		attrs = append(attrs, attrCluster.String(cluster))
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, "clickhouse.statement",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endSpan ends span, flagging it as failed when err is not nil. The error
+// message is not taken from err, which may contain secrets, but from
+// sanitized.
+func endSpan(span trace.Span, err error, sanitized string) {
+	if err != nil {
+		if code := errorCode(err); code != errorCodeNone {
+			span.SetAttributes(attrExceptionCode.String(code))
+		}
+		span.SetStatus(codes.Error, sanitized)
+	}
+	span.End()
+}
+
+// traceQueryOptions propagates the span of ctx to ClickHouse, so the query
+// shows up in system.opentelemetry_span_log, and sets its trace ID as the
+// log_comment of the query in system.query_log.
+func traceQueryOptions(ctx context.Context, settings clickhouse.Settings) []clickhouse.QueryOption {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.IsValid() {
+		return nil
+	}
+	settings["log_comment"] = "vault trace_id=" + spanCtx.TraceID().String()
+
+	return []clickhouse.QueryOption{clickhouse.WithSpan(spanCtx)}
+}
+
+// clusterOf returns the cluster of the ON CLUSTER clause of query, if any
+func clusterOf(query string) string {
+	match := onClusterRegexp.FindStringSubmatch(query)
+	if match == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(match[1])
+}
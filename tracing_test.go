@@ -0,0 +1,111 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+
+	return recorder
+}
+
+func Test_clusterOf(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "Should return an empty string without ON CLUSTER",
+			query: "CREATE USER 'bob' IDENTIFIED BY 'secret'",
+			want:  "",
+		},
+		{
+			name:  "Should return a quoted cluster",
+			query: "CREATE USER 'bob' ON CLUSTER 'my_cluster' IDENTIFIED BY 'secret'",
+			want:  "my_cluster",
+		},
+		{
+			name:  "Should return an unquoted cluster regardless of case",
+			query: "drop user if exists 'bob' on cluster my_cluster",
+			want:  "my_cluster",
+		},
+		{
+			name:  "Should return a macro cluster",
+			query: "GRANT readonly TO 'bob' ON CLUSTER '{cluster}'",
+			want:  "{cluster}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterOf(tt.query); got != tt.want {
+				t.Errorf("clusterOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_statementSpan(t *testing.T) {
+	recorder := newTestSpanRecorder(t)
+
+	ctx, opSpan := startOperationSpan(t.Context(), operationNewUser, attrRole.String("readonly"))
+	stmtCtx, stmtSpan := startStatementSpan(ctx, operationNewUser, 1, "GRANT readonly TO 'bob' ON CLUSTER 'my_cluster'", "someHost:9000")
+
+	settings := clickhouse.Settings{}
+	opts := traceQueryOptions(stmtCtx, settings)
+	require.Len(t, opts, 1)
+	require.Equal(t, "vault trace_id="+stmtSpan.SpanContext().TraceID().String(), settings["log_comment"])
+
+	err := &StatementError{
+		Operation: operationNewUser,
+		Index:     1,
+		Err:       &clickhouse.Exception{Code: codeUnknownRole, Message: "There is no role `readonly`"},
+	}
+	endSpan(stmtSpan, err, "sanitized message")
+	endSpan(opSpan, err, "sanitized message")
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	stmt := spans[0]
+	require.Equal(t, "clickhouse.statement", stmt.Name())
+	require.Equal(t, spans[1].SpanContext().SpanID(), stmt.Parent().SpanID())
+	require.Equal(t, codes.Error, stmt.Status().Code)
+	require.Equal(t, "sanitized message", stmt.Status().Description)
+	require.Subset(t, stmt.Attributes(), []attribute.KeyValue{
+		attrOperation.String(operationNewUser),
+		attrStatementIndex.Int(1),
+		attrCluster.String("my_cluster"),
+		attrServerAddress.String("someHost:9000"),
+		attrExceptionCode.String("511"),
+	})
+
+	op := spans[1]
+	require.Equal(t, "clickhouse.NewUser", op.Name())
+	require.Subset(t, op.Attributes(), []attribute.KeyValue{
+		attrOperation.String(operationNewUser),
+		attrRole.String("readonly"),
+	})
+}
+
+func Test_traceQueryOptions_withoutSpan(t *testing.T) {
+	settings := clickhouse.Settings{}
+	require.Empty(t, traceQueryOptions(t.Context(), settings))
+	require.Empty(t, settings)
+}
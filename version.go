@@ -0,0 +1,105 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	goversion "github.com/hashicorp/go-version"
+)
+
+const modulePath = "github.com/contentsquare/vault-plugin-database-clickhouse"
+
+// BuildInfo is the version and VCS metadata the plugin was built with
+type BuildInfo struct {
+	// Version is the semantic version of the plugin module, empty when unknown
+	Version string
+	// Revision is the VCS revision, Time its commit time and Modified whether
+	// the working tree had local changes
+	Revision string
+	Time     string
+	Modified bool
+}
+
+// String formats the build info for the --version output of the plugin
+func (b BuildInfo) String() string {
+	version := b.Version
+	if version == "" {
+		version = "unknown"
+	}
+	var details []string
+	if b.Revision != "" {
+		commit := "commit " + b.Revision
+		if b.Modified {
+			commit += " (modified)"
+		}
+		details = append(details, commit)
+	}
+	if b.Time != "" {
+		details = append(details, "committed "+b.Time)
+	}
+	if len(details) == 0 {
+		return version
+	}
+
+	return fmt.Sprintf("%s, %s", version, strings.Join(details, ", "))
+}
+
+// ReadBuildInfo returns the build metadata embedded by the Go toolchain. The
+// version is the one of the plugin module, whether it is the main module or a
+// dependency of it, and is left empty unless it is a valid plugin version.
+func ReadBuildInfo() BuildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{}
+	}
+
+	return buildInfoFrom(info)
+}
+
+func buildInfoFrom(info *debug.BuildInfo) BuildInfo {
+	b := BuildInfo{}
+	var module *debug.Module
+	if info.Main.Path == modulePath {
+		module = &info.Main
+	}
+	for _, dep := range info.Deps {
+		if module == nil && dep.Path == modulePath {
+			module = dep
+			if dep.Replace != nil {
+				module = dep.Replace
+			}
+		}
+	}
+	if module != nil && validatePluginVersion(module.Version) == nil {
+		b.Version = module.Version
+	}
+	// The VCS settings are the ones of the main module only
+	if info.Main.Path == modulePath {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				b.Revision = setting.Value
+			case "vcs.time":
+				b.Time = setting.Value
+			case "vcs.modified":
+				b.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	return b
+}
+
+// validatePluginVersion checks that version is a semantic version, as Vault
+// requires for the versions of external plugins
+func validatePluginVersion(version string) error {
+	if _, err := goversion.NewSemver(version); err != nil {
+		return fmt.Errorf("invalid plugin version %q: %w", version, err)
+	}
+	if strings.HasSuffix(version, "+builtin") || strings.Contains(version, "+builtin.") {
+		return fmt.Errorf("invalid plugin version %q: the builtin metadata is reserved for Vault builtin plugins", version)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package vault_plugin_database_clickhouse
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildInfoFrom(t *testing.T) {
+	vcs := []debug.BuildSetting{
+		{Key: "vcs", Value: "git"},
+		{Key: "vcs.revision", Value: "b1ad9a7148115123a7c1c29ace60963a8b873c18"},
+		{Key: "vcs.time", Value: "2025-06-06T10:00:00Z"},
+		{Key: "vcs.modified", Value: "true"},
+	}
+	tests := []struct {
+		name string
+		info *debug.BuildInfo
+		want BuildInfo
+	}{
+		{
+			name: "Should return the version and VCS metadata of the main module",
+			info: &debug.BuildInfo{
+				Main:     debug.Module{Path: modulePath, Version: "v0.4.0"},
+				Settings: vcs,
+			},
+			want: BuildInfo{
+				Version:  "v0.4.0",
+				Revision: "b1ad9a7148115123a7c1c29ace60963a8b873c18",
+				Time:     "2025-06-06T10:00:00Z",
+				Modified: true,
+			},
+		},
+		{
+			name: "Should accept pseudo-versions of dirty builds",
+			info: &debug.BuildInfo{
+				Main: debug.Module{Path: modulePath, Version: "v0.4.1-0.20250606100000-b1ad9a714811+dirty"},
+			},
+			want: BuildInfo{Version: "v0.4.1-0.20250606100000-b1ad9a714811+dirty"},
+		},
+		{
+			name: "Should leave the version of development builds empty",
+			info: &debug.BuildInfo{
+				Main:     debug.Module{Path: modulePath, Version: "(devel)"},
+				Settings: vcs[:2],
+			},
+			want: BuildInfo{Revision: "b1ad9a7148115123a7c1c29ace60963a8b873c18"},
+		},
+		{
+			name: "Should return the version of the module as a dependency, without the VCS metadata of the main module",
+			info: &debug.BuildInfo{
+				Main:     debug.Module{Path: "example.com/vault", Version: "v1.0.0"},
+				Deps:     []*debug.Module{{Path: modulePath, Version: "v0.3.0"}},
+				Settings: vcs,
+			},
+			want: BuildInfo{Version: "v0.3.0"},
+		},
+		{
+			name: "Should return the version of the replacement of the module",
+			info: &debug.BuildInfo{
+				Main: debug.Module{Path: "example.com/vault"},
+				Deps: []*debug.Module{{Path: modulePath, Version: "v0.3.0", Replace: &debug.Module{Path: "example.com/fork", Version: "v0.3.1"}}},
+			},
+			want: BuildInfo{Version: "v0.3.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, buildInfoFrom(tt.info))
+		})
+	}
+}
+
+func Test_validatePluginVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		wantErr bool
+	}{
+		{name: "Should accept a release version", version: "v1.2.3"},
+		{name: "Should accept a version without the v prefix", version: "1.2.3"},
+		{name: "Should accept a pre-release version", version: "0.0.1-test"},
+		{name: "Should reject an empty version", version: "", wantErr: true},
+		{name: "Should reject a development version", version: "(devel)", wantErr: true},
+		{name: "Should reject a git describe output", version: "main-3-gb1ad9a7", wantErr: true},
+		{name: "Should reject the builtin metadata", version: "v1.2.3+builtin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePluginVersion(tt.version)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestBuildInfo_String(t *testing.T) {
+	require.Equal(t, "unknown", BuildInfo{}.String())
+	require.Equal(t, "v0.4.0, commit b1ad9a7 (modified), committed 2025-06-06T10:00:00Z",
+		BuildInfo{Version: "v0.4.0", Revision: "b1ad9a7", Time: "2025-06-06T10:00:00Z", Modified: true}.String())
+}
+
+func TestNew_invalidVersion(t *testing.T) {
+	_, err := New(DefaultUserNameTemplate, "main-3-gb1ad9a7")()
+	require.ErrorContains(t, err, `invalid plugin version "main-3-gb1ad9a7"`)
+}